@@ -0,0 +1,125 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BlobCache is the per-user cache of downloaded blobs, shared by all
+// installed datasets. Blobs are fetched into the cache once, and dataset
+// files are materialized from it (see BlobCache.Link). So installing a
+// new version of a dataset only downloads the blobs that changed.
+type BlobCache struct {
+	store *FileStore
+	link  string
+}
+
+const DefaultBlobCacheDir = "~/.data/blobs"
+
+// Ways of materializing files from the cache (blobcache.link):
+const (
+	// reflink (copy-on-write) if the filesystem supports it, else copy.
+	BlobCacheLinkAuto = "auto"
+
+	// reflink, else copy.
+	BlobCacheLinkReflink = "reflink"
+
+	// hardlink, else copy. Beware: hardlinked files share the cached
+	// blob, so modifying them in place corrupts the cache.
+	BlobCacheLinkHardlink = "hardlink"
+
+	// always copy.
+	BlobCacheLinkCopy = "copy"
+)
+
+// Returns the user's blob cache, configured by:
+//
+//	blobcache.path       cache directory (default ~/.data/blobs)
+//	blobcache.link       auto | reflink | hardlink | copy
+//	blobcache.disabled   do not use a blob cache
+//
+// Returns nil if the cache is disabled.
+func configBlobCache() (*BlobCache, error) {
+	if ConfigGetBool("blobcache.disabled", false) {
+		return nil, nil
+	}
+
+	dir := expandUser(ConfigGetString("blobcache.path", DefaultBlobCacheDir))
+	link := ConfigGetString("blobcache.link", BlobCacheLinkAuto)
+	return NewBlobCache(dir, link)
+}
+
+func NewBlobCache(dir string, link string) (*BlobCache, error) {
+	switch link {
+	case BlobCacheLinkAuto, BlobCacheLinkReflink, BlobCacheLinkHardlink,
+		BlobCacheLinkCopy:
+	default:
+		return nil, fmt.Errorf("Invalid blobcache.link '%s'. Use one of: "+
+			"auto, reflink, hardlink, copy.", link)
+	}
+
+	s, err := NewFileStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobCache{store: s, link: link}, nil
+}
+
+// Returns the path of the cached copy of blob named by hash.
+func (c *BlobCache) Path(hash string) string {
+	return c.store.Path(BlobKey(hash))
+}
+
+func (c *BlobCache) Has(hash string) (bool, error) {
+	return c.store.Has(BlobKey(hash))
+}
+
+func (c *BlobCache) Put(hash string, r io.Reader) error {
+	return c.store.Put(BlobKey(hash), r)
+}
+
+func (c *BlobCache) Get(hash string) (io.ReadCloser, error) {
+	return c.store.Get(BlobKey(hash))
+}
+
+func (c *BlobCache) GetFrom(hash string, offset int64) (io.ReadCloser, error) {
+	return getBlobFrom(c.store, BlobKey(hash), offset)
+}
+
+// Materializes the cached blob named by hash at fpath.
+func (c *BlobCache) Link(hash string, fpath string) error {
+	src := c.Path(hash)
+
+	err := os.MkdirAll(filepath.Dir(fpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	// links fail if the target exists.
+	err = os.Remove(fpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	switch c.link {
+	case BlobCacheLinkAuto, BlobCacheLinkReflink:
+		if reflinkFile(src, fpath) == nil {
+			return nil
+		}
+	case BlobCacheLinkHardlink:
+		if os.Link(src, fpath) == nil {
+			return nil
+		}
+	}
+
+	dOut("blob cache: %s copying %s %s\n", c.link, shortHash(hash), fpath)
+	return copyFile(src, fpath)
+}
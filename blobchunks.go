@@ -0,0 +1,241 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Large blobs are stored as content-defined chunks (see Chunker), each
+// a blob of its own, plus a chunk index listing them in order. The chunk
+// index is stored under the hash of the whole contents, so Manifests
+// still name files by the hash of their contents, and chunking stays
+// invisible to everything but the blobstore transfers.
+
+// serializable into YAML
+type ChunkIndex struct {
+	Size   int64
+	Chunks []Chunk
+}
+
+type Chunk struct {
+	Hash string
+	Size int64
+}
+
+// Returns the blobstore key for the chunk index of blob
+func ChunkIndexKey(hash string) string {
+	return hashKey("chunks", hash)
+}
+
+// Returns whether file at fpath should be stored as chunks.
+func shouldChunk(fpath string) (bool, error) {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() > ChunkThreshold, nil
+}
+
+// DataIndex extension to upload a blob as chunks. Only chunks not
+// already in the blobstore are uploaded. The chunk index is uploaded
+// last, once all its chunks are present. Progress is reported to bp.
+func (i *DataIndex) putChunkedBlob(hash string, fpath string, bp *blobProgress) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// hash the whole contents along the way, for integrity.
+	algo := hashAlgorithm(hash)
+	h, err := newHasher(algo)
+	if err != nil {
+		return err
+	}
+	c := NewChunker(io.TeeReader(throttle(f), h))
+	ci := &ChunkIndex{}
+
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		ch, err := readerHash(bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+
+		ci.Chunks = append(ci.Chunks, Chunk{Hash: ch, Size: int64(len(chunk))})
+		ci.Size += int64(len(chunk))
+
+		exists, err := i.BlobStore.Has(BlobKey(ch))
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			dOut("put chunk %s %s - exists\n", shortHash(hash), shortHash(ch))
+			bp.skip(int64(len(chunk)))
+			continue
+		}
+
+		dOut("put chunk %s %s - uploading\n", shortHash(hash), shortHash(ch))
+		err = i.BlobStore.Put(BlobKey(ch), bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+		bp.add(int64(len(chunk)))
+	}
+
+	vh := formatHash(algo, h.Sum(nil))
+	if vh != hash {
+		m := "put blob: %s hash error (expected %s, got %s)"
+		return fmt.Errorf(m, fpath, hash, vh)
+	}
+
+	r, err := Marshal(ci)
+	if err != nil {
+		return err
+	}
+
+	return i.BlobStore.Put(ChunkIndexKey(hash), r)
+}
+
+// DataIndex extension to get the chunk index of a blob.
+// Returns nil if the blob is not stored as chunks.
+func (i *DataIndex) getChunkIndex(hash string) (*ChunkIndex, error) {
+	exists, err := i.BlobStore.Has(ChunkIndexKey(hash))
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	r, err := i.BlobStore.Get(ChunkIndexKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ci := &ChunkIndex{}
+	err = Unmarshal(r, ci)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk index for %s: %v", shortHash(hash), err)
+	}
+
+	return ci, nil
+}
+
+// DataIndex extension to get one chunk, through the local cache if any.
+// Caching chunks means new versions of a large file only download the
+// chunks that changed.
+func (i *DataIndex) getChunk(hash string) (io.ReadCloser, error) {
+	if i.BlobCache == nil {
+		return i.getVerifiedBlob(hash)
+	}
+
+	cached, err := i.BlobCache.Has(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cached {
+		r, err := i.getVerifiedBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		// fails (caching nothing) if the chunk does not verify.
+		err = i.BlobCache.Put(hash, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return i.BlobCache.Get(hash)
+}
+
+// Gets whole blob from the remote blobstore, verified as it is read.
+func (i *DataIndex) getVerifiedBlob(hash string) (io.ReadCloser, error) {
+	r, err := i.BlobStore.Get(BlobKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	return verifyBlob(r, hash)
+}
+
+// Reads the contents of a chunked blob, fetching chunks as needed.
+type chunkedBlobReader struct {
+	index  *DataIndex
+	chunks []Chunk
+	cur    io.ReadCloser
+	skip   int64 // bytes to skip in the first chunk
+}
+
+// Returns a reader of the chunked blob's contents, from offset.
+func newChunkedBlobReader(i *DataIndex, ci *ChunkIndex, offset int64) *chunkedBlobReader {
+	r := &chunkedBlobReader{index: i, chunks: ci.Chunks, skip: offset}
+
+	// skip whole chunks before offset.
+	for len(r.chunks) > 0 && r.chunks[0].Size <= r.skip {
+		r.skip -= r.chunks[0].Size
+		r.chunks = r.chunks[1:]
+	}
+	return r
+}
+
+func (r *chunkedBlobReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			c, err := r.index.getChunk(r.chunks[0].Hash)
+			if err != nil {
+				return 0, err
+			}
+
+			if r.skip > 0 {
+				c, err = skipReader(c, r.skip)
+				if err != nil {
+					return 0, err
+				}
+				r.skip = 0
+			}
+
+			r.cur = c
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkedBlobReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
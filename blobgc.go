@@ -0,0 +1,495 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gonuts/flag"
+	"github.com/jbenet/commander"
+)
+
+var cmd_data_blob_gc = &commander.Command{
+	UsageLine: "gc [--cache [--installed <dirs>]] [--min-age=<duration>] [<dataset>...]",
+	Short:     "Find (and delete) unreferenced blobs.",
+	Long: `data blob gc - Find (and delete) unreferenced blobs.
+
+    Lists everything in the blobstore, and finds the blobs not referenced
+    by any published version of any dataset in the index (e.g. orphaned
+    by re-uploads, or by republishing with --force). Reports them, and
+    their sizes. Nothing is deleted unless run with --dry-run=false.
+
+    The index does not list its datasets. They are found in the
+    blobstore: every published version's manifest is stored, and tracks
+    the Datafile naming its dataset. (Manifests whose Datafile cannot be
+    read keep all their blobs.) This reads the start of every stored
+    blob. Named datasets must exist.
+
+    Objects modified more recently than --min-age (default 24h) are never
+    deleted, so uploads not yet published (or in progress) are kept.
+
+    With --cache, collects the local blob cache instead. Its blobs are
+    referenced by the installed datasets (and the given ones). The cache
+    is shared by all datasets on this machine: --installed lists every
+    directory datasets are installed in (separated like $PATH; default
+    datasets/, in the working directory), and each must exist. Cached
+    blobs only needed by datasets installed elsewhere are collected.
+
+      > data blob gc --cache --installed $HOME/a/datasets:$HOME/b/datasets
+
+    See data blob.
+
+Arguments:
+
+    <dataset>   dataset (<author>/<name>) whose published versions
+                reference blobs.
+
+  `,
+	Run:  blobGcCmd,
+	Flag: *flag.NewFlagSet("data-blob-gc", flag.ExitOnError),
+}
+
+func init() {
+	cmd_data_blob_gc.Flag.Bool("dry-run", true, "report unreferenced blobs only")
+	cmd_data_blob_gc.Flag.Bool("cache", false, "collect the local blob cache")
+	cmd_data_blob_gc.Flag.String("installed", DatasetDir, "dirs of installed datasets (with --cache)")
+	cmd_data_blob_gc.Flag.String("min-age", "24h", "keep objects modified more recently")
+	cmd_data_blob_gc.Flag.Int("jobs", 0, jobsFlagUsage)
+}
+
+func blobGcCmd(c *commander.Command, args []string) error {
+	dryRun := c.Flag.Lookup("dry-run").Value.Get().(bool)
+	cache := c.Flag.Lookup("cache").Value.Get().(bool)
+
+	minAge, err := time.ParseDuration(c.Flag.Lookup("min-age").Value.Get().(string))
+	if err != nil {
+		return fmt.Errorf("%v: invalid --min-age: %v", c.FullName(), err)
+	}
+
+	di, err := NewMainDataIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
+	// collect stored objects, as stored (not through codecs, etc).
+	var store blobStore
+	if cache {
+		if di.BlobCache == nil {
+			return fmt.Errorf("%v: blob cache is disabled.", c.FullName())
+		}
+		store = di.BlobCache.store
+	} else {
+		store, err = newBlobStore(configBlobStore(di.Name), di)
+		if err != nil {
+			return err
+		}
+	}
+
+	gc := &blobGc{
+		index:             di,
+		reached:           map[string]bool{},
+		packed:            map[string]bool{},
+		marked:            map[string]bool{},
+		listsChunkIndexes: !cache,
+		minAge:            minAge,
+	}
+
+	if err := gc.list(store); err != nil {
+		return err
+	}
+
+	for _, dataset := range args {
+		if err := gc.markDataset(dataset, true); err != nil {
+			return err
+		}
+	}
+
+	if cache {
+		dirs := c.Flag.Lookup("installed").Value.Get().(string)
+		for _, dir := range filepath.SplitList(dirs) {
+			if err := gc.markInstalled(dir); err != nil {
+				return fmt.Errorf("%v: %v", c.FullName(), err)
+			}
+		}
+	} else {
+		err = gc.markIndex()
+	}
+	if err != nil {
+		return err
+	}
+
+	unreferenced, err := gc.sweep()
+	if err != nil {
+		return err
+	}
+
+	return gc.report(store, unreferenced, dryRun)
+}
+
+// blobGc finds the blobs (and chunks, packs) reachable from manifests.
+type blobGc struct {
+	index   *DataIndex
+	reached map[string]bool // blobstore keys
+	hashes  []string        // reached blob hashes
+	packed  map[string]bool // reached blob hashes stored in packs
+
+	// whether the listed store holds the chunk indexes (i.e. is not the cache)
+	listsChunkIndexes bool
+
+	marked map[string]bool // datasets
+	lk     sync.Mutex      // guards marking, from parallel manifest reads
+
+	stored   map[string]int64     // { key : size }
+	modified map[string]time.Time // { key : last modified }
+	total    int64
+	minAge   time.Duration // objects modified since are kept
+	recent   int           // unreferenced objects kept, as modified since
+}
+
+func (gc *blobGc) markBlob(hash string) {
+	key := BlobKey(hash)
+	if !gc.reached[key] {
+		gc.reached[key] = true
+		gc.hashes = append(gc.hashes, hash)
+	}
+}
+
+// Marks all published versions of dataset. Datasets not in the index
+// are an error if mustExist (else, have no published versions).
+func (gc *blobGc) markDataset(dataset string, mustExist bool) error {
+	h := NewHandle(dataset)
+	if gc.marked[h.Path()] {
+		return nil
+	}
+	gc.marked[h.Path()] = true
+
+	ri := gc.index.RefIndex(h.Path())
+	err := ri.FetchRefs(false)
+	if _, notFound := err.(*NotFoundError); notFound && !mustExist {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error finding refs for %v. %s", h.Path(), err)
+	}
+
+	for _, ref := range ri.SortedPublished() {
+		mf, err := NewManifestWithRef(ref)
+		if err != nil {
+			return fmt.Errorf("Error reading manifest %s of %v. %s",
+				shortHash(ref), h.Path(), err)
+		}
+
+		dOut("data blob gc: marking %s %s\n", h.Path(), shortHash(ref))
+		gc.markBlob(ref)
+		if err := gc.markManifest(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Marks the manifests of the datasets installed in dir.
+func (gc *blobGc) markInstalled(dir string) error {
+	authors, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no installed datasets at %s (see --installed)", dir)
+		}
+		return err
+	}
+
+	for _, a := range authors {
+		datasets, err := ioutil.ReadDir(path.Join(dir, a.Name()))
+		if err != nil {
+			continue
+		}
+
+		for _, d := range datasets {
+			p := path.Join(dir, a.Name(), d.Name(), ManifestFileName)
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+
+			dOut("data blob gc: marking %s\n", p)
+			if err := gc.markManifest(NewManifest(p)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (gc *blobGc) markManifest(mf *Manifest) error {
+	for p, hash := range mf.Files {
+		if !IsHash(hash) {
+			continue
+		}
+		gc.markBlob(hash)
+
+		if p == PacksFileName {
+			pi := NewPackIndex("")
+			if err := pi.ReadBlob(hash); err != nil {
+				return fmt.Errorf("Error reading pack index %s. %s", shortHash(hash), err)
+			}
+
+			for _, pack := range pi.Packs {
+				gc.reached[PackKey(pack.Hash)] = true
+				for _, b := range pack.Blobs {
+					gc.packed[b.Hash] = true
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Marks all published versions of every dataset with a manifest in the
+// (listed) store. See manifestDataset.
+func (gc *blobGc) markIndex() error {
+	keys := []string{}
+	for key := range gc.stored {
+		if gc.reached[key] {
+			continue // known. e.g. a manifest of a marked dataset.
+		}
+
+		_, whole := keyHash("blob", key)
+		_, chunked := keyHash("chunks", key)
+		if whole || chunked {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	datasets := make([]string, len(keys))
+	errs := parallel(len(keys), gc.index.Jobs, func(n int) error {
+		var err error
+		datasets[n], err = gc.manifestDataset(keys[n])
+		if err != nil {
+			return fmt.Errorf("%s: %v", keys[n], err)
+		}
+		return nil
+	})
+
+	err := newTransferErrors("read manifest", len(keys), errs)
+	if err != nil {
+		return err
+	}
+
+	for _, dataset := range datasets {
+		if len(dataset) == 0 {
+			continue
+		}
+
+		if err := gc.markDataset(dataset, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Manifests start with a version, or a <path>: <hash> line.
+var manifestStartRE = regexp.MustCompile(`^(version: \d+\n|[^\n]+: ([a-z0-9]+:)?[0-9a-f]{40,}\n)`)
+
+// Returns the dataset of the manifest stored at key (whole, or as chunks),
+// or "" if it is not a manifest. Manifests whose Datafile cannot be read
+// are marked whole instead.
+func (gc *blobGc) manifestDataset(key string) (string, error) {
+	var r io.ReadCloser
+	var err error
+	hash, chunked := keyHash("chunks", key)
+	if chunked {
+		ci, cerr := gc.index.getChunkIndex(hash)
+		if cerr != nil || ci == nil {
+			return "", cerr
+		}
+		r = newChunkedBlobReader(gc.index, ci, 0)
+	} else {
+		hash, _ = keyHash("blob", key)
+		r, err = gc.index.BlobStore.Get(key)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer r.Close()
+
+	// sniff, to read only manifests whole.
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(512)
+	if !manifestStartRE.Match(start) {
+		return "", nil
+	}
+
+	mf := NewManifest("")
+	if err := mf.Read(br); err != nil {
+		return "", nil // not a manifest.
+	}
+
+	dfHash, found := mf.Files[DatafileName]
+	if !found || !IsHash(dfHash) {
+		return "", nil
+	}
+
+	df, err := gc.readDatafile(mf, dfHash)
+	if err != nil || !df.Valid() {
+		pErr("data blob gc: cannot read Datafile of manifest %s. Keeping its blobs.\n", key)
+		gc.lk.Lock()
+		defer gc.lk.Unlock()
+		gc.markBlob(hash)
+		return "", gc.markManifest(mf)
+	}
+	return df.Handle().Path(), nil
+}
+
+// Reads the Datafile (blob hash) of manifest mf, from its packs if packed.
+func (gc *blobGc) readDatafile(mf *Manifest, hash string) (*Datafile, error) {
+	r, err := io.ReadCloser(nil), error(nil)
+	if packs, found := mf.Files[PacksFileName]; found && IsHash(packs) {
+		pi := NewPackIndex("")
+		if err := pi.ReadBlobFrom(gc.index, packs); err != nil {
+			return nil, err
+		}
+		pi.reindex()
+
+		r, err = gc.index.findPackedBlobIn(pi, hash, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r == nil {
+		r, err = gc.index.findBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer r.Close()
+
+	df, _ := NewDatafile("")
+	return df, df.Read(r)
+}
+
+// Lists the store's objects.
+func (gc *blobGc) list(store blobStore) error {
+	ls, ok := store.(listBlobStore)
+	if !ok {
+		return fmt.Errorf("blobstore cannot list its blobs: %s", store.Url(""))
+	}
+
+	gc.stored = map[string]int64{}
+	gc.modified = map[string]time.Time{}
+	return ls.List("", func(key string, size int64, modified time.Time) error {
+		gc.stored[key] = size
+		gc.modified[key] = modified
+		gc.total += size
+		return nil
+	})
+}
+
+// Returns the unreferenced keys (sorted), except recently modified ones.
+func (gc *blobGc) sweep() ([]string, error) {
+
+	// blobs stored as chunks reach their chunk index, and chunks.
+	for _, hash := range gc.hashes {
+		_, whole := gc.stored[BlobKey(hash)]
+		_, chunked := gc.stored[ChunkIndexKey(hash)]
+		switch {
+		case gc.listsChunkIndexes && !chunked:
+			continue
+
+		// the cache keeps no chunk indexes. ask the blobstore about blobs
+		// not cached whole.
+		case !gc.listsChunkIndexes && (whole || gc.packed[hash]):
+			continue
+		}
+
+		ci, err := gc.index.getChunkIndex(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if ci != nil {
+			gc.reached[ChunkIndexKey(hash)] = true
+			for _, c := range ci.Chunks {
+				gc.reached[BlobKey(c.Hash)] = true
+			}
+		}
+	}
+
+	unreferenced := []string{}
+	for key, _ := range gc.stored {
+		if gc.reached[key] {
+			continue
+		}
+
+		// unknown times count as recent.
+		if time.Since(gc.modified[key]) < gc.minAge || gc.modified[key].IsZero() {
+			gc.recent++
+			continue
+		}
+		unreferenced = append(unreferenced, key)
+	}
+	sort.Strings(unreferenced)
+	return unreferenced, nil
+}
+
+func (gc *blobGc) report(store blobStore, unreferenced []string, dryRun bool) error {
+	size := int64(0)
+	for _, key := range unreferenced {
+		size += gc.stored[key]
+		pOut("%9s  %s\n", humanBytes(gc.stored[key]), key)
+	}
+
+	pErr("data blob gc: %d objects (%s) stored, %d unreferenced (%s).\n",
+		len(gc.stored), humanBytes(gc.total), len(unreferenced), humanBytes(size))
+	if gc.recent > 0 {
+		pErr("data blob gc: kept %d unreferenced objects modified within %v.\n",
+			gc.recent, gc.minAge)
+	}
+
+	if dryRun || len(unreferenced) == 0 {
+		if len(unreferenced) > 0 {
+			pErr("Dry run: nothing deleted. Use --dry-run=false to delete.\n")
+		}
+		return nil
+	}
+
+	ds, ok := store.(deleteBlobStore)
+	if !ok {
+		return fmt.Errorf("blobstore cannot delete blobs: %s", store.Url(""))
+	}
+
+	var lk sync.Mutex
+	freed := int64(0)
+	errs := parallel(len(unreferenced), gc.index.Jobs, func(n int) error {
+		key := unreferenced[n]
+		if err := ds.Delete(key); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		lk.Lock()
+		freed += gc.stored[key]
+		lk.Unlock()
+		return nil
+	})
+
+	pErr("data blob gc: deleted %d objects (%s).\n",
+		len(unreferenced)-len(errs), humanBytes(freed))
+	return newTransferErrors("delete blob", len(unreferenced), errs)
+}
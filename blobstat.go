@@ -0,0 +1,310 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gonuts/flag"
+	"github.com/jbenet/commander"
+)
+
+var cmd_data_blob_stat = &commander.Command{
+	UsageLine: "stat [--yaml] [--dataset <dataset>] <hash>... | --all",
+	Short:     "Show how blobs are stored, and their sizes.",
+	Long: `data blob stat - Show how blobs are stored, and their sizes.
+
+    Shows, for each blob, whether the blobstore stores it whole, as
+    chunks, or in a packfile (or is missing it), the size of its contents,
+    and the bytes it takes up in the blobstore (as stored, i.e. compressed,
+    or encrypted). Sizes are asked of the blobstore (HEAD, or stat),
+    without downloading anything.
+
+    Chunked blobs missing any chunk (or their chunk index) are shown as
+    missing. Packed blobs show the bytes they take up in their packfile
+    (unknown for packs written whole, by older versions).
+
+    --all shows all blobs in the manifest. --yaml outputs yaml, for
+    scripts.
+
+    Packed blobs are found through the pack index of the dataset in the
+    working directory. --dataset uses a published dataset's manifest
+    (and pack index) instead, e.g. to stat blobs from anywhere:
+
+      > data blob stat --dataset jbenet/foo@1.0 --all
+
+    See data blob, and data pack stats.
+
+Arguments:
+
+    <hash>   name (cryptographic hash, checksum) of the blob.
+
+  `,
+	Run:  blobStatCmd,
+	Flag: *flag.NewFlagSet("data-blob-stat", flag.ExitOnError),
+}
+
+func init() {
+	cmd_data_blob_stat.Flag.Bool("all", false, "all blobs in the manifest")
+	cmd_data_blob_stat.Flag.Bool("yaml", false, "output yaml")
+	cmd_data_blob_stat.Flag.String("dataset", "", "published dataset to stat blobs of")
+	cmd_data_blob_stat.Flag.Int("jobs", 0, jobsFlagUsage)
+}
+
+// Blob forms, as stored in blobstores.
+const (
+	BlobWhole   = "whole"
+	BlobChunked = "chunked"
+	BlobPacked  = "packed"
+	BlobMissing = "missing"
+)
+
+// serializable into YAML
+type BlobStat struct {
+	Hash   string
+	Path   string ",omitempty"
+	Form   string // BlobWhole, BlobChunked, BlobPacked, or BlobMissing
+	Size   int64  // of the contents. -1 if unknown.
+	Stored int64  // bytes in the blobstore (incl. chunk index). -1 if unknown.
+	// (packed blobs count their share of the pack, if known.)
+}
+
+// serializable into YAML
+type BlobStats struct {
+	Blobs   []BlobStat
+	Size    int64 // of known sizes
+	Stored  int64 // of known sizes
+	Missing int
+}
+
+func blobStatCmd(c *commander.Command, args []string) error {
+	all := c.Flag.Lookup("all").Value.Get().(bool)
+	dataset := c.Flag.Lookup("dataset").Value.Get().(string)
+
+	if !all && len(args) < 1 {
+		return fmt.Errorf("%v: requires <hash> argument (or --all)", c.FullName())
+	}
+
+	di, err := NewMainDataIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
+	// the dataset here, or the one named.
+	local := len(dataset) == 0
+	var mf *Manifest
+	var pi *PackIndex
+	if local {
+		mf, pi = NewDefaultManifest(), di.packIndex()
+	} else {
+		mf, pi, err = di.publishedManifest(dataset)
+		if err != nil {
+			return err
+		}
+	}
+
+	blobs := blobPaths{}
+	if all {
+		blobs = validBlobHashes(mf.Files)
+		if len(blobs) < 1 {
+			return fmt.Errorf("%v: no blobs tracked in manifest.", c.FullName())
+		}
+	} else {
+		for _, hash := range args {
+			if !IsHash(hash) {
+				return fmt.Errorf("%v: invalid hash '%s'", c.FullName(), hash)
+			}
+			blobs[hash] = hash // no path.
+		}
+	}
+
+	// sizes as stored (not through codecs, etc).
+	store, err := newBlobStore(configBlobStore(di.Name), di)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for path := range blobs {
+		paths = append(paths, path)
+	}
+
+	stats := &BlobStats{Blobs: make([]BlobStat, len(paths))}
+	errs := parallel(len(paths), di.Jobs, func(n int) error {
+		hash := blobs[paths[n]]
+		st, err := di.blobStat(store, pi, hash)
+		if err != nil {
+			return err
+		}
+
+		if paths[n] != hash {
+			st.Path = paths[n]
+			if e, found := mf.Entry(st.Path); found && st.Size < 0 {
+				st.Size = e.Size
+			} else if fi, err := os.Stat(st.Path); err == nil && local && st.Size < 0 {
+				st.Size = fi.Size()
+			}
+		}
+		stats.Blobs[n] = *st
+		return nil
+	})
+	if err := newTransferErrors("stat blob", len(paths), errs); err != nil {
+		return err
+	}
+
+	for _, st := range stats.Blobs {
+		if st.Form == BlobMissing {
+			stats.Missing++
+		}
+		if st.Size > 0 {
+			stats.Size += st.Size
+		}
+		if st.Stored > 0 {
+			stats.Stored += st.Stored
+		}
+	}
+
+	if c.Flag.Lookup("yaml").Value.Get().(bool) {
+		buf, err := Marshal(stats)
+		if err != nil {
+			return err
+		}
+		pOut("%s", buf)
+		return nil
+	}
+
+	for _, st := range stats.Blobs {
+		pOut("%s %-7s %10s %10s %s\n", shortHash(st.Hash), st.Form,
+			statBytes(st.Size), statBytes(st.Stored), st.Path)
+	}
+	pOut("data blob: %d blobs, %s (%s stored), %d missing.\n", len(stats.Blobs),
+		humanBytes(stats.Size), humanBytes(stats.Stored), stats.Missing)
+	return nil
+}
+
+// DataIndex extension to find how blob is stored in store (the index's
+// blobstore, as stored), and its sizes. Packed blobs are found in pi.
+func (i *DataIndex) blobStat(store blobStore, pi *PackIndex, hash string) (*BlobStat, error) {
+	st := &BlobStat{Hash: hash, Form: BlobMissing, Size: -1, Stored: -1}
+
+	if _, b, packed := pi.Find(hash); packed {
+		st.Form = BlobPacked
+		st.Size = b.Size
+		if b.Stored > 0 {
+			st.Stored = b.Stored // unknown in packs encoded whole.
+		}
+		return st, nil
+	}
+
+	size, exists, err := statBlob(store, BlobKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		st.Form = BlobWhole
+		st.Stored = size
+		return st, nil
+	}
+
+	ci, err := i.getChunkIndex(hash)
+	if err != nil || ci == nil {
+		return st, err
+	}
+
+	st.Form = BlobChunked
+	st.Size = ci.Size
+
+	keys := []string{ChunkIndexKey(hash)}
+	for _, c := range ci.Chunks {
+		keys = append(keys, BlobKey(c.Hash))
+	}
+
+	keys = set(keys)
+	sizes, err := statBlobs(store, keys, i.Jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// chunked blobs missing chunks cannot be got: they are missing (what
+	// is there is still counted as stored).
+	if len(sizes) < len(keys) {
+		st.Form = BlobMissing
+	}
+
+	st.Stored = 0
+	for _, size := range sizes {
+		if size < 0 {
+			st.Stored = -1
+			break
+		}
+		st.Stored += size
+	}
+	return st, nil
+}
+
+// DataIndex extension to read the manifest of a published dataset (at
+// the version named, or the latest), and its pack index.
+func (i *DataIndex) publishedManifest(dataset string) (*Manifest, *PackIndex, error) {
+	ref, err := i.handleRef(NewHandle(dataset))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mf := NewManifest("")
+	if err := mf.ReadBlobFrom(i, ref); err != nil {
+		return nil, nil, fmt.Errorf("Error reading manifest %s of %v. %s",
+			shortHash(ref), dataset, err)
+	}
+
+	pi := NewPackIndex("")
+	if hash, found := mf.Files[PacksFileName]; found && IsHash(hash) {
+		if err := pi.ReadBlobFrom(i, hash); err != nil {
+			return nil, nil, fmt.Errorf("Error reading pack index %s. %s",
+				shortHash(hash), err)
+		}
+		pi.reindex()
+	}
+	return mf, pi, nil
+}
+
+// Returns the stored sizes of keys in store (-1 if unknown). Keys not
+// stored are left out.
+func statBlobs(store blobStore, keys []string, jobs int) (map[string]int64, error) {
+	sizes := make([]int64, len(keys))
+	found := make([]bool, len(keys))
+	errs := parallel(len(keys), jobs, func(n int) error {
+		var err error
+		sizes[n], found[n], err = statBlob(store, keys[n])
+		return err
+	})
+
+	err := newTransferErrors("stat blob", len(keys), errs)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := map[string]int64{}
+	for n, key := range keys {
+		if found[n] {
+			stored[key] = sizes[n]
+		}
+	}
+	return stored, nil
+}
+
+// Sizes, or "?" if unknown.
+func statBytes(n int64) string {
+	if n < 0 {
+		return "?"
+	}
+	return humanBytes(n)
+}
@@ -0,0 +1,170 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type blobStore interface {
+	Has(key string) (bool, error)
+	Put(key string, value io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Url(key string) string
+}
+
+// blobStores that can read part of a blob. length < 0 reads to the end.
+type rangeBlobStore interface {
+	blobStore
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// Reads blob from offset, with a ranged read if the store supports them.
+func getBlobFrom(s blobStore, key string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.Get(key)
+	}
+
+	if rs, ok := s.(rangeBlobStore); ok {
+		return rs.GetRange(key, offset, -1)
+	}
+
+	r, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return skipReader(r, offset)
+}
+
+// Blob stores that can list what they store (e.g. to collect garbage).
+type listBlobStore interface {
+	// Calls fn with each key stored under prefix, its stored size, and
+	// when it was last modified.
+	List(prefix string, fn func(key string, size int64, modified time.Time) error) error
+}
+
+// Blob stores that can tell the size of what they store (as stored, i.e.
+// compressed, or encrypted), without reading it. Size is -1 if unknown.
+type statBlobStore interface {
+	Stat(key string) (size int64, exists bool, err error)
+}
+
+// Returns the stored size of key (-1 if unknown), and whether it exists.
+func statBlob(s blobStore, key string) (int64, bool, error) {
+	if ss, ok := s.(statBlobStore); ok {
+		return ss.Stat(key)
+	}
+
+	exists, err := s.Has(key)
+	return -1, exists, err
+}
+
+// Blob stores that can delete blobs.
+type deleteBlobStore interface {
+	Delete(key string) error
+}
+
+// Opens length bytes of blob at key, from offset.
+func getBlobRange(s blobStore, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil // nothing to ask for.
+	}
+
+	if rs, ok := s.(rangeBlobStore); ok {
+		return rs.GetRange(key, offset, length)
+	}
+
+	r, err := getBlobFrom(s, key, offset)
+	if err != nil {
+		return nil, err
+	}
+	return limitReadCloser(r, length), nil
+}
+
+// Limits r to length bytes (length < 0 does not limit it).
+func limitReadCloser(r io.ReadCloser, length int64) io.ReadCloser {
+	if r == nil || length < 0 {
+		return r
+	}
+	return &limitedReadCloser{io.LimitReader(r, length), r}
+}
+
+// Skips the first n bytes of r. (For servers that ignore ranges.)
+func skipReader(r io.ReadCloser, n int64) (io.ReadCloser, error) {
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the value of a http Range header. (length must not be 0: empty
+// ranges cannot be expressed.)
+func httpRange(offset int64, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// Returns the body of a (perhaps ranged) response, starting at offset.
+// Servers may ignore ranges, and send everything.
+func rangeResponseBody(resp *http.Response, offset int64) (io.ReadCloser, error) {
+	if resp.StatusCode == http.StatusPartialContent || offset == 0 {
+		return resp.Body, nil
+	}
+	return skipReader(resp.Body, offset)
+}
+
+// The blobstore used when an index does not configure one.
+const DefaultBlobStore = "s3://datadex.archives"
+
+// Constructs a blobStore from its (parsed) url.
+type blobStoreCtor func(u *url.URL, index *DataIndex) (blobStore, error)
+
+// map { scheme : ctor }. Backends register themselves in init().
+var blobStoreCtors = map[string]blobStoreCtor{}
+
+func registerBlobStore(scheme string, ctor blobStoreCtor) {
+	if _, exists := blobStoreCtors[scheme]; exists {
+		panic("blobstore scheme registered twice: " + scheme)
+	}
+	blobStoreCtors[scheme] = ctor
+}
+
+// Constructs the blobStore backend named by rawurl. The url scheme selects
+// the backend, e.g.
+//
+//	s3://datadex.archives
+//	file:///srv/blobs
+//	http://example.com/blobs
+func newBlobStore(rawurl string, index *DataIndex) (blobStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blobstore url '%s': %v", rawurl, err)
+	}
+
+	ctor, found := blobStoreCtors[strings.ToLower(u.Scheme)]
+	if !found {
+		return nil, fmt.Errorf("Unsupported blobstore '%s' (scheme: '%s')",
+			rawurl, u.Scheme)
+	}
+
+	return ctor(u, index)
+}
+
+// Returns the blobstore url configured for index (index.<name>.blobstore)
+func configBlobStore(index string) string {
+	key := fmt.Sprintf("index.%s.blobstore", index)
+	return ConfigGetString(key, DefaultBlobStore)
+}
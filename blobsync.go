@@ -0,0 +1,273 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gonuts/flag"
+	"github.com/jbenet/commander"
+)
+
+var cmd_data_blob_sync = &commander.Command{
+	UsageLine: "sync --to <blobstore> [--from <blobstore>] <dataset>...",
+	Short:     "Copy datasets' blobs between blobstores.",
+	Long: `data blob sync - Copy datasets' blobs between blobstores.
+
+    Copies everything the given datasets are made of (all published
+    versions: manifests, files, chunks, and packfiles) from one
+    blobstore to another, e.g. to mirror datasets in an internal store.
+    Only blobs missing in the destination are copied. Blobs are copied
+    as stored (compressed, or encrypted).
+
+    --from defaults to the index's blobstore. Blobstores are given as
+    urls (see data blob). S3 stores read the index's s3 options unless
+    given their own in the url:
+
+      > data blob sync --to file:///srv/blobs jbenet/foo
+      > data blob sync --to 's3://mirror?endpoint=minio:9000' jbenet/foo
+
+    See data blob.
+
+Arguments:
+
+    <dataset>   dataset (<author>/<name>[@<version>]) to copy. Without
+                a version, all published versions are copied. A bare
+                <author> copies all the author's datasets.
+
+  `,
+	Run:  blobSyncCmd,
+	Flag: *flag.NewFlagSet("data-blob-sync", flag.ExitOnError),
+}
+
+func init() {
+	cmd_data_blob_sync.Flag.String("from", "", "source blobstore url")
+	cmd_data_blob_sync.Flag.String("to", "", "destination blobstore url")
+	cmd_data_blob_sync.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_blob_sync.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_blob_sync.Flag.String("limit-rate", "", limitRateFlagUsage)
+}
+
+func blobSyncCmd(c *commander.Command, args []string) error {
+	from := c.Flag.Lookup("from").Value.Get().(string)
+	to := c.Flag.Lookup("to").Value.Get().(string)
+
+	if len(to) == 0 {
+		return fmt.Errorf("%v: requires --to <blobstore> argument", c.FullName())
+	}
+
+	if len(args) < 1 {
+		return fmt.Errorf("%v: requires <dataset> argument", c.FullName())
+	}
+
+	di, err := NewMainDataIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
+	if len(from) == 0 {
+		from = configBlobStore(di.Name)
+	}
+
+	s, err := newBlobSync(di, from, to)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range args {
+		if err := s.addDatasets(arg); err != nil {
+			return err
+		}
+	}
+
+	return s.run()
+}
+
+// blobSync copies the blobstore objects composing datasets.
+type blobSync struct {
+	src  *DataIndex // reads (decodes) manifests, etc. from the source
+	from blobStore  // as stored
+	to   blobStore
+
+	// keys of blobs, chunks, and packfiles.
+	data []string
+
+	// keys of chunk indexes and manifests, copied once what they
+	// reference is there.
+	indexes []string
+
+	seen map[string]bool
+}
+
+func newBlobSync(di *DataIndex, from string, to string) (*blobSync, error) {
+	s := &blobSync{seen: map[string]bool{}}
+
+	var err error
+	s.from, err = newBlobStore(from, di)
+	if err != nil {
+		return nil, err
+	}
+
+	s.to, err = newBlobStore(to, di)
+	if err != nil {
+		return nil, err
+	}
+
+	s.src = &DataIndex{Name: di.Name, Http: di.Http, Jobs: di.Jobs}
+	s.src.BlobStore, err = newCryptStore(s.from, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s.src.BlobStore, err = newCodecStore(s.src.BlobStore, CodecNone)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *blobSync) add(keys *[]string, key string) {
+	if !s.seen[key] {
+		s.seen[key] = true
+		*keys = append(*keys, key)
+	}
+}
+
+// Adds dataset, or (given a bare <author>) all the author's datasets.
+func (s *blobSync) addDatasets(arg string) error {
+	if strings.Contains(arg, "/") {
+		return s.addDataset(arg)
+	}
+
+	profile, err := s.src.NewUserIndex(arg).GetInfo()
+	if err != nil {
+		return fmt.Errorf("Error finding datasets of %s. %s", arg, err)
+	}
+
+	for _, dataset := range profile.Packages {
+		if err := s.addDataset(dataset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the published versions of dataset (or only the version named).
+func (s *blobSync) addDataset(dataset string) error {
+	h := NewHandle(dataset)
+	ri := s.src.RefIndex(h.Path())
+	err := ri.FetchRefs(false)
+	if err != nil {
+		return fmt.Errorf("Error finding refs for %v. %s", h.Path(), err)
+	}
+
+	refs := ri.SortedPublished()
+	if len(h.Version) > 0 {
+		ref, err := ri.VersionRef(h.Version)
+		if err != nil {
+			return fmt.Errorf("Error finding version %v. %s", h.Dataset(), err)
+		}
+		refs = []string{ref}
+	}
+
+	for _, ref := range refs {
+		mf := NewManifest("")
+		err := mf.ReadBlobFrom(s.src, ref)
+		if err != nil {
+			return fmt.Errorf("Error reading manifest %s of %v. %s",
+				shortHash(ref), h.Path(), err)
+		}
+
+		pErr("sync %s %s - %d files\n", h.Path(), shortHash(ref), len(mf.Files))
+		if err := s.addManifest(mf, ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blobSync) addManifest(mf *Manifest, ref string) error {
+	objs, err := s.src.manifestObjects(mf, ref)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range objs.Data {
+		s.add(&s.data, key)
+	}
+	for _, key := range objs.Indexes {
+		s.add(&s.indexes, key)
+	}
+	return nil
+}
+
+// Copies what is missing in the destination: data first, then indexes.
+func (s *blobSync) run() error {
+	for _, keys := range [][]string{s.data, s.indexes} {
+		missing, err := s.missing(keys)
+		if err != nil {
+			return err
+		}
+
+		errs := parallel(len(missing), s.src.Jobs, func(n int) error {
+			pErr("sync %s - copying\n", missing[n])
+			return copyStoredBlob(s.from, s.to, missing[n])
+		})
+
+		err = newTransferErrors("copy blob", len(missing), errs)
+		if err != nil {
+			return err
+		}
+	}
+
+	pErr("sync: %d objects in sync.\n", len(s.data)+len(s.indexes))
+	return nil
+}
+
+func (s *blobSync) missing(keys []string) ([]string, error) {
+	var lk sync.Mutex
+	missing := []string{}
+	errs := parallel(len(keys), s.src.Jobs, func(n int) error {
+		exists, err := s.to.Has(keys[n])
+		if err != nil || exists {
+			return err
+		}
+
+		lk.Lock()
+		missing = append(missing, keys[n])
+		lk.Unlock()
+		return nil
+	})
+	return missing, newTransferErrors("has blob", len(keys), errs)
+}
+
+// Copies the object at key, as stored (keeping its codec).
+func copyStoredBlob(from blobStore, to blobStore, key string) error {
+	fc, fok := from.(codecBlobStore)
+	tc, tok := to.(codecBlobStore)
+	if fok && tok {
+		r, codec, err := fc.GetEncoded(key, 0)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return tc.PutEncoded(key, throttle(r), codec)
+	}
+
+	r, err := from.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return to.Put(key, throttle(r))
+}
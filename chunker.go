@@ -0,0 +1,95 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"io"
+)
+
+// Content-defined chunking. Chunk boundaries are chosen where a rolling
+// (gear) hash of the content matches a pattern, so they move with the
+// content: inserting or appending data only changes the chunks around
+// the edit, and all other chunks keep their hashes (and dedup).
+//
+// WARNING: changing any of these values (or the gear table) changes where
+// files are cut, which defeats dedup against previously uploaded chunks.
+const (
+	ChunkMinSize = 256 * 1024
+	ChunkMaxSize = 4 * 1024 * 1024
+
+	// boundary when the top 20 bits of the hash are zero: ~1MB average.
+	chunkMask = uint64(1<<20-1) << 44
+)
+
+// Files larger than this are stored as chunks.
+const ChunkThreshold = 2 * ChunkMaxSize
+
+var chunkGear [256]uint64
+
+func init() {
+	// fixed pseudo-random table (splitmix64), identical on every machine.
+	seed := uint64(0x64617461) // "data"
+	for i := range chunkGear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		chunkGear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // bytes buffered
+	eof bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, ChunkMaxSize)}
+}
+
+// Returns the next chunk, or io.EOF once the stream is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunkBoundary(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// Returns the length of the first chunk in buf.
+func chunkBoundary(buf []byte) int {
+	if len(buf) <= ChunkMinSize {
+		return len(buf)
+	}
+
+	h := uint64(0)
+	for i := ChunkMinSize; i < len(buf); i++ {
+		h = (h << 1) + chunkGear[buf[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(buf)
+}
@@ -0,0 +1,159 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+func chunkAll(t *testing.T, buf []byte) [][]byte {
+	chunks := [][]byte{}
+	c := NewChunker(bytes.NewReader(buf))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunkerRoundTrip(t *testing.T) {
+	buf := randomBytes(1, 20<<20)
+	chunks := chunkAll(t, buf)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+
+	if !bytes.Equal(bytes.Join(chunks, nil), buf) {
+		t.Fatal("joined chunks differ from the input")
+	}
+}
+
+func TestChunkerSizeBounds(t *testing.T) {
+	buf := randomBytes(2, 20<<20)
+	chunks := chunkAll(t, buf)
+	for n, chunk := range chunks {
+		last := n == len(chunks)-1
+		if len(chunk) > ChunkMaxSize || (!last && len(chunk) <= ChunkMinSize) {
+			t.Errorf("chunk %d: size %d out of bounds", n, len(chunk))
+		}
+	}
+
+	// content without boundaries is cut at the max size.
+	zeros := chunkAll(t, make([]byte, 3*ChunkMaxSize))
+	for n, chunk := range zeros {
+		if len(chunk) != ChunkMaxSize {
+			t.Errorf("zeros chunk %d: size %d, expected %d", n, len(chunk), ChunkMaxSize)
+		}
+	}
+
+	// small inputs are one chunk.
+	small := chunkAll(t, []byte("small"))
+	if len(small) != 1 || string(small[0]) != "small" {
+		t.Errorf("small input: %q", small)
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	buf := randomBytes(3, 20<<20)
+	a, b := chunkAll(t, buf), chunkAll(t, buf)
+	if len(a) != len(b) {
+		t.Fatalf("chunk counts differ: %d, %d", len(a), len(b))
+	}
+	for n := range a {
+		if !bytes.Equal(a[n], b[n]) {
+			t.Fatalf("chunk %d differs", n)
+		}
+	}
+}
+
+func TestChunkerInsertShiftsLocalChunks(t *testing.T) {
+	buf := randomBytes(4, 20<<20)
+	mid := len(buf) / 2
+	edited := append(append(append([]byte{}, buf[:mid]...), "inserted"...), buf[mid:]...)
+
+	before := map[string]bool{}
+	chunks := chunkAll(t, buf)
+	for _, chunk := range chunks {
+		before[string(chunk)] = true
+	}
+
+	changed := 0
+	for _, chunk := range chunkAll(t, edited) {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+
+	// the edited chunk, and perhaps its neighbor (if a boundary moved).
+	if changed > 2 {
+		t.Fatalf("%d of %d chunks changed by one insert", changed, len(chunks))
+	}
+}
+
+func TestChunkedBlobRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &DataIndex{BlobStore: fs, Jobs: 2}
+
+	buf := randomBytes(5, ChunkThreshold+3<<20)
+	fpath := filepath.Join(dir, "big")
+	if err := ioutil.WriteFile(fpath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := readerHash(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bp := currentProgress().startBlob("put blob", -1)
+	if err := i.putChunkedBlob(hash, fpath, bp); err != nil {
+		t.Fatal(err)
+	}
+
+	ci, err := i.getChunkIndex(hash)
+	if err != nil || ci == nil {
+		t.Fatal("no chunk index", err)
+	}
+	if ci.Size != int64(len(buf)) || len(ci.Chunks) < 2 {
+		t.Fatalf("chunk index: size %d, %d chunks", ci.Size, len(ci.Chunks))
+	}
+
+	for _, offset := range []int64{0, 1, ChunkMaxSize + 7, int64(len(buf))} {
+		got, err := ioutil.ReadAll(newChunkedBlobReader(i, ci, offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, buf[offset:]) {
+			t.Fatalf("reassembled blob differs, from offset %d", offset)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Blob compression codecs. Blobs are still named by the hash of their
+// uncompressed contents; the codec is kept in the stored object's
+// metadata, and reversed on the way out.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// The object metadata header that carries the codec (S3 user metadata,
+// which S3-compatible http servers keep too).
+const CodecHeader = "X-Amz-Meta-Data-Codec"
+
+// Blob stores that can keep a codec with each object.
+type codecBlobStore interface {
+	blobStore
+
+	// Puts value, already encoded with codec (CodecNone if raw).
+	PutEncoded(key string, value io.Reader, codec string) error
+
+	// Returns the stored contents, and their codec. Raw contents start at
+	// offset; encoded ones are returned whole (offsets are meaningless).
+	GetEncoded(key string, offset int64) (io.ReadCloser, string, error)
+}
+
+// codecStore compresses blobs put into a store with codec, and
+// decompresses blobs got from it, whichever codec they were put with.
+type codecStore struct {
+	codecBlobStore
+	codec string
+}
+
+// Wraps s to compress blobs with codec. Stores that cannot keep codecs
+// are returned as they are (and refuse compression).
+func newCodecStore(s blobStore, codec string) (blobStore, error) {
+	if err := checkCodec(codec); err != nil {
+		return nil, err
+	}
+
+	cs, ok := s.(codecBlobStore)
+	if !ok {
+		if codec != CodecNone {
+			return nil, fmt.Errorf("blobstore does not support compression: %s",
+				s.Url(""))
+		}
+		return s, nil
+	}
+
+	return &codecStore{codecBlobStore: cs, codec: codec}, nil
+}
+
+// Returns the codec configured for index (index.<name>.compression)
+func configBlobCodec(index string) string {
+	key := fmt.Sprintf("index.%s.compression", index)
+	return ConfigGetString(key, CodecNone)
+}
+
+func checkCodec(codec string) error {
+	switch codec {
+	case CodecNone, CodecGzip, CodecZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression codec: %s", codec)
+}
+
+// Blobs put whole are small (larger ones are chunked), so they are
+// compressed in memory. This also keeps them resendable when retrying.
+func (s *codecStore) Put(key string, value io.Reader) error {
+	if s.codec == CodecNone {
+		return s.PutEncoded(key, value, CodecNone)
+	}
+
+	raw, err := ioutil.ReadAll(value)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = encode(&buf, bytes.NewReader(raw), s.codec)
+	if err != nil {
+		return err
+	}
+
+	// incompressible (e.g. already compressed) contents are stored raw.
+	if buf.Len() >= len(raw) {
+		return s.PutEncoded(key, bytes.NewReader(raw), CodecNone)
+	}
+
+	dOut("compressed %s %d -> %d (%s)\n", key, len(raw), buf.Len(), s.codec)
+	return s.PutEncoded(key, bytes.NewReader(buf.Bytes()), s.codec)
+}
+
+func (s *codecStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetRange(key, 0, -1)
+}
+
+func (s *codecStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	r, codec, err := s.GetEncoded(key, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec != CodecNone {
+		r, err = decode(r, codec)
+		if err != nil {
+			return nil, err
+		}
+
+		if offset > 0 {
+			r, err = skipReader(r, offset)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if length < 0 {
+		return r, nil
+	}
+	return &limitedReadCloser{io.LimitReader(r, length), r}, nil
+}
+
+// Returns the codec named by object metadata (empty means none).
+func metadataCodec(codec string) (string, error) {
+	if len(codec) == 0 {
+		return CodecNone, nil
+	}
+	return codec, checkCodec(codec)
+}
+
+// GetEncoded for http stores. get does a GET from offset, returning
+// successful responses only.
+func getEncodedResponse(get func(offset int64) (*http.Response, error), offset int64) (io.ReadCloser, string, error) {
+	resp, err := get(offset)
+	if err != nil {
+		return nil, "", err
+	}
+
+	codec, err := metadataCodec(resp.Header.Get(CodecHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, "", err
+	}
+
+	if codec == CodecNone {
+		r, err := rangeResponseBody(resp, offset)
+		return r, codec, err
+	}
+
+	// got part of the encoded contents. all are needed to decode.
+	if resp.StatusCode == http.StatusPartialContent {
+		resp.Body.Close()
+		resp, err = get(0)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return resp.Body, codec, nil
+}
+
+func encode(w io.Writer, r io.Reader, codec string) error {
+	var enc io.WriteCloser
+	switch codec {
+	case CodecGzip:
+		enc = gzip.NewWriter(w)
+	case CodecZstd:
+		z, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		enc = z
+	default:
+		return checkCodec(codec)
+	}
+
+	_, err := io.Copy(enc, r)
+	if err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// Returns a reader decoding r. Closing it closes r.
+func decode(r io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return r, nil
+
+	case CodecGzip:
+		g, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &decodingReader{g, func() { g.Close() }, r}, nil
+
+	case CodecZstd:
+		z, err := zstd.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &decodingReader{z, z.Close, r}, nil
+	}
+
+	r.Close()
+	return nil, checkCodec(codec)
+}
+
+type decodingReader struct {
+	io.Reader
+	release func() // frees the decoder
+	src     io.Closer
+}
+
+func (d *decodingReader) Close() error {
+	d.release()
+	return d.src.Close()
+}
@@ -0,0 +1,267 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// cryptStore encrypts blobs put into a store (AES-256-GCM) before they
+// leave the machine, and decrypts blobs got from it. Blobs are still named
+// by the hash of their plaintext, so they dedup as before. Encrypted
+// blobs name their key, so anyone holding it can read them:
+//
+//	"DATAENC1" <key name length (1 byte)> <key name> <nonce> <ciphertext>
+//
+// cryptStore sits below codecStore: blobs are compressed, then encrypted.
+type cryptStore struct {
+	codecBlobStore
+
+	// name of the key new blobs are encrypted with. empty for none.
+	key string
+}
+
+var cryptMagic = []byte("DATAENC1")
+
+// Wraps s to encrypt new blobs with the named key (if any), and to decrypt
+// encrypted blobs with theirs.
+func newCryptStore(s blobStore, key string) (blobStore, error) {
+	cs, ok := s.(codecBlobStore)
+	if !ok {
+		if len(key) > 0 {
+			return nil, fmt.Errorf("blobstore does not support encryption: %s",
+				s.Url(""))
+		}
+		return s, nil
+	}
+
+	// the key is loaded when first needed (putting, or reading an encrypted
+	// blob): commands that do neither need not configure it.
+	return &cryptStore{codecBlobStore: cs, key: key}, nil
+}
+
+func (s *cryptStore) Put(key string, value io.Reader) error {
+	return s.PutEncoded(key, value, CodecNone)
+}
+
+func (s *cryptStore) Get(key string) (io.ReadCloser, error) {
+	r, codec, err := s.GetEncoded(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	return decode(r, codec)
+}
+
+func (s *cryptStore) PutEncoded(key string, value io.Reader, codec string) error {
+	if len(s.key) == 0 {
+		return s.codecBlobStore.PutEncoded(key, value, codec)
+	}
+
+	plain, err := ioutil.ReadAll(value)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sealBlob(s.key, key, plain)
+	if err != nil {
+		return err
+	}
+
+	return s.codecBlobStore.PutEncoded(key, bytes.NewReader(sealed), codec)
+}
+
+func (s *cryptStore) GetEncoded(key string, offset int64) (io.ReadCloser, string, error) {
+	r, codec, err := s.codecBlobStore.GetEncoded(key, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	head := make([]byte, len(cryptMagic))
+	n, err := io.ReadFull(r, head)
+	switch {
+	case err == io.EOF, err == io.ErrUnexpectedEOF, // too short to be encrypted.
+		err == nil && !bytes.Equal(head, cryptMagic):
+
+		if offset > 0 && codec == CodecNone {
+			r.Close()
+			return s.codecBlobStore.GetEncoded(key, offset)
+		}
+
+		head := bytes.NewReader(head[:n])
+		return &limitedReadCloser{io.MultiReader(head, r), r}, codec, nil
+
+	case err != nil:
+		r.Close()
+		return nil, "", netError(err)
+	}
+
+	// encrypted. (encrypted blobs are small: large ones are chunked.)
+	rest, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, "", netError(err)
+	}
+
+	plain, err := openBlob(key, append(head, rest...))
+	if err != nil {
+		return nil, "", err
+	}
+
+	pr := bytes.NewReader(plain)
+	if codec == CodecNone && offset > 0 {
+		pr.Seek(offset, os.SEEK_SET)
+	}
+	return ioutil.NopCloser(pr), codec, nil
+}
+
+// Encrypts plain, stored under key (bound to it, so ciphertexts cannot be
+// swapped around), with the named encryption key.
+func sealBlob(keyName string, key string, plain []byte) ([]byte, error) {
+	gcm, err := blobCipher(keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, cryptMagic...)
+	header = append(header, byte(len(keyName)))
+	header = append(header, keyName...)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	aad := append(append([]byte{}, header...), key...)
+	sealed := append(header, nonce...)
+	return gcm.Seal(sealed, nonce, plain, aad), nil
+}
+
+// Decrypts sealed, stored under key.
+func openBlob(key string, sealed []byte) ([]byte, error) {
+	malformed := fmt.Errorf("%s: malformed encrypted blob", key)
+
+	m := len(cryptMagic)
+	if len(sealed) < m+1 {
+		return nil, malformed
+	}
+
+	n := int(sealed[m])
+	if len(sealed) < m+1+n {
+		return nil, malformed
+	}
+	header := sealed[:m+1+n]
+	keyName := string(header[m+1:])
+
+	gcm, err := blobCipher(keyName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: encrypted with key '%s': %v", key, keyName, err)
+	}
+
+	rest := sealed[len(header):]
+	if len(rest) < gcm.NonceSize() {
+		return nil, malformed
+	}
+
+	nonce := rest[:gcm.NonceSize()]
+	aad := append(append([]byte{}, header...), key...)
+	plain, err := gcm.Open(nil, nonce, rest[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decryption with key '%s' failed (wrong key?)",
+			key, keyName)
+	}
+	return plain, nil
+}
+
+func blobCipher(keyName string) (cipher.AEAD, error) {
+	k, err := loadKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Length of blob encryption keys (AES-256).
+const KeySize = 32
+
+var keys = map[string][]byte{}
+var keysLk sync.Mutex
+
+// Returns the named key, configured by either:
+//
+//	keys.<name>.file         keyfile holding the key (hex, or 32 raw bytes)
+//	keys.<name>.passphrase   passphrase to derive the key from
+func loadKey(name string) ([]byte, error) {
+	keysLk.Lock()
+	defer keysLk.Unlock()
+
+	if k, found := keys[name]; found {
+		return k, nil
+	}
+
+	if len(name) == 0 || len(name) > 255 {
+		return nil, fmt.Errorf("invalid key name: '%s'", name)
+	}
+
+	prefix := fmt.Sprintf("keys.%s.", name)
+	file := ConfigGetString(prefix+"file", "")
+	pass := ConfigGetString(prefix+"passphrase", "")
+
+	var k []byte
+	var err error
+	switch {
+	case len(file) > 0:
+		k, err = readKeyFile(expandUser(file))
+	case len(pass) > 0:
+		// salted with the name, so that all holders derive the same key.
+		k, err = scrypt.Key([]byte(pass), []byte("data key "+name),
+			1<<15, 8, 1, KeySize)
+	default:
+		err = fmt.Errorf("key '%s' not configured. Set %sfile or %spassphrase.",
+			name, prefix, prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys[name] = k
+	return k, nil
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) == KeySize {
+		return buf, nil
+	}
+
+	k, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(k) != KeySize {
+		return nil, fmt.Errorf("keyfile %s: expected %d bytes (or %d hex digits)",
+			path, KeySize, 2*KeySize)
+	}
+	return k, nil
+}
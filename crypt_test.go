@@ -0,0 +1,221 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sets (or, if nil, unsets) the named key. Returns a func restoring it.
+func withKey(name string, k []byte) func() {
+	keysLk.Lock()
+	old, found := keys[name]
+	if k == nil {
+		delete(keys, name)
+	} else {
+		keys[name] = k
+	}
+	keysLk.Unlock()
+
+	return func() {
+		keysLk.Lock()
+		defer keysLk.Unlock()
+		if found {
+			keys[name] = old
+		} else {
+			delete(keys, name)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	defer withKey("test", bytes.Repeat([]byte{7}, KeySize))()
+
+	plain := []byte("some secret data")
+	sealed, err := sealBlob("test", "blob/x", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, cryptMagic) || bytes.Contains(sealed, plain) {
+		t.Fatal("not encrypted")
+	}
+
+	opened, err := openBlob("blob/x", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Fatalf("opened %q, expected %q", opened, plain)
+	}
+
+	// bound to the key it is stored under.
+	if _, err := openBlob("blob/y", sealed); err == nil {
+		t.Fatal("opened under another blob key")
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	restore := withKey("test", bytes.Repeat([]byte{1}, KeySize))
+	defer restore()
+
+	sealed, err := sealBlob("test", "blob/x", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withKey("test", bytes.Repeat([]byte{2}, KeySize))
+	if _, err := openBlob("blob/x", sealed); err == nil {
+		t.Fatal("opened with the wrong key")
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	defer withKey("test", bytes.Repeat([]byte{3}, KeySize))()
+
+	sealed, err := sealBlob("test", "blob/x", []byte("data to tamper with"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[n] ^= 0x01
+		if _, err := openBlob("blob/x", tampered); err == nil {
+			t.Fatalf("opened with byte %d flipped", n)
+		}
+	}
+
+	if _, err := openBlob("blob/x", sealed[:len(sealed)-1]); err == nil {
+		t.Fatal("opened truncated")
+	}
+}
+
+func TestLoadKeyPassphrase(t *testing.T) {
+	old, found := Config["keys"]
+	Config["keys"] = map[string]interface{}{
+		"a": map[string]interface{}{"passphrase": "correct horse"},
+		"b": map[string]interface{}{"passphrase": "correct horse"},
+	}
+	defer func() {
+		if found {
+			Config["keys"] = old
+		} else {
+			delete(Config, "keys")
+		}
+	}()
+	defer withKey("a", nil)()
+	defer withKey("b", nil)()
+
+	a, err := loadKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != KeySize {
+		t.Fatalf("key size %d", len(a))
+	}
+
+	// derived the same by all holders, but salted with the name.
+	withKey("a", nil)
+	a2, err := loadKey("a")
+	if err != nil || !bytes.Equal(a, a2) {
+		t.Fatal("derivation differs", err)
+	}
+
+	b, err := loadKey("b")
+	if err != nil || bytes.Equal(a, b) {
+		t.Fatal("same passphrase, other name: same key", err)
+	}
+
+	if _, err := loadKey("unconfigured"); err == nil {
+		t.Fatal("loaded an unconfigured key")
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	k := bytes.Repeat([]byte{0xab}, KeySize)
+	files := map[string][]byte{
+		"raw":   k,
+		"hex":   []byte(hex.EncodeToString(k) + "\n"),
+		"short": k[:KeySize-1],
+		"bad":   []byte("not a key"),
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"raw", "hex"} {
+		got, err := readKeyFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, k) {
+			t.Errorf("%s keyfile: %x, %v", name, got, err)
+		}
+	}
+
+	for _, name := range []string{"short", "bad", "missing"} {
+		if _, err := readKeyFile(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s keyfile: no error", name)
+		}
+	}
+}
+
+func TestCryptStore(t *testing.T) {
+	defer withKey("test", bytes.Repeat([]byte{4}, KeySize))()
+
+	dir, err := ioutil.TempDir("", "data-crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newCryptStore(fs, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("stored encrypted")
+	if err := s.Put("blob/x", bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := ioutil.ReadFile(fs.Path("blob/x"))
+	if err != nil || !bytes.HasPrefix(stored, cryptMagic) {
+		t.Fatal("not stored encrypted", err)
+	}
+
+	// unencrypted blobs still read as they are.
+	if err := fs.Put("blob/y", bytes.NewReader(plain)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"blob/x", "blob/y"} {
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("%s: got %q, %v", key, got, err)
+		}
+	}
+}
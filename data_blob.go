@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/gonuts/flag"
 	"github.com/jbenet/commander"
@@ -29,6 +30,9 @@ var cmd_data_blob = &commander.Command{
     url <hash>            Output Url for blob named by <hash>.
     show <hash>           Output blob contents for hash.
     hash <path>           Output hash for blob contents.
+    stat <hash>...        Show how blobs are stored, and their sizes.
+    gc [<dataset>...]     Find (and delete) unreferenced blobs.
+    sync <dataset>...     Copy datasets' blobs between blobstores.
 
   Arguments:
 
@@ -40,18 +44,27 @@ var cmd_data_blob = &commander.Command{
   What is a blob?
 
     Datasets are made up of files, which are made up of blobs.
-    (For now, 1 file is 1 blob. Chunking to be implemented)
+    Small files are 1 blob. Large files are split into chunks at
+    content-defined boundaries, each chunk a blob, so that changing
+    part of a large file only uploads (and downloads) the changed
+    chunks. Either way, files are named by the hash of their contents.
     Blobs are basically blocks of data, which are checksummed
     (for integrity, de-duplication, and addressing) using a crypto-
-    graphic hash function (sha1, for now). If git comes to mind,
-    that's exactly right.
+    graphic hash function (sha256). If git comes to mind, that's
+    exactly right. Hashes are written <algorithm>:<hex>, e.g.
+    sha256:9f86d0... Older datasets use sha1 hashes, written as bare
+    hex; these are still understood, and verified with sha1.
 
   Local Blobstores
 
-    data stores blobs in blobstores. Every local dataset has a
-    blobstore (local caching with links TBI). Like in git, the blobs
-    are stored safely in the blobstore (different directory) and can
-    be used to reconstruct any corrupted/deleted/modified dataset files.
+    data stores blobs in blobstores. Downloaded blobs are kept in one
+    local cache (~/.data/blobs) shared by all installed datasets. Like
+    in git, the blobs are stored safely in the blobstore (different
+    directory) and can be used to reconstruct any corrupted/deleted/
+    modified dataset files. Dataset files are materialized from the
+    cache as copies (or reflinks/hardlinks, see blobcache.link).
+
+    The cache is configured with blobcache.{path, link, disabled}.
 
   Remote Blobstores
 
@@ -66,9 +79,66 @@ var cmd_data_blob = &commander.Command{
     together to ensure consistency. Please do not publish datasets to
     an index if blobs aren't in that index)
 
-    data can use any remote blobstore you wish. (For now, you have to
-    recompile, but in the future, you will be able to) Just change the
-    datadex configuration variable. Or pass in "-s <url>" per command.
+    data can use any remote blobstore you wish. Just set the index's
+    blobstore configuration variable to a url. The url scheme selects
+    the kind of blobstore:
+
+      > data config index.datadex.blobstore s3://datadex.archives
+
+    Supported blobstores:
+
+      s3://<bucket>         an Amazon S3 bucket.
+      file://<directory>    a local (or shared network) directory.
+      http[s]://<url>       any http server supporting HEAD, GET and PUT.
+
+    S3 blobstores can be pointed at other S3-compatible services (e.g.
+    MinIO, Ceph RGW) with index.<name>.s3.{endpoint, region, tls,
+    pathstyle} options. Credentials are taken from the environment
+    (AWS_ACCESS_KEY_ID, ...), then ~/.aws/credentials (profile set by
+    index.<name>.s3.profile), and otherwise requested from the index.
+    Options can also be given in the url, replacing the index's (e.g.
+    for data blob sync): s3://<bucket>?endpoint=minio:9000&pathstyle=1
+
+    Requests are signed with AWS signature version 2: region only picks
+    the endpoint, and regions accepting only version 4 (eu-central-1,
+    and all regions opened since 2014) refuse requests with 403.
+
+    (If not set, the datadex blobstore, s3://datadex.archives, is used.)
+
+    Blobs can be compressed in transit and at rest, per index:
+
+      > data config index.datadex.compression zstd
+
+    Codecs are gzip, zstd, and none (default). Blobs are still named
+    by the hash of their uncompressed contents; the codec is kept in
+    the stored object's metadata, so blobs put with any codec can be
+    read back. (http blobstores must keep the X-Amz-Meta-Data-Codec
+    header, as S3-compatible servers do.)
+
+    Blobs can also be encrypted (AES-256-GCM) before they leave the
+    machine, e.g. for datasets under embargo. Name a key in the Datafile
+    (key: <name>), and configure it with either a keyfile (32 bytes, or
+    64 hex digits) or a passphrase:
+
+      > data config keys.<name>.file ~/.data/keys/<name>
+      > data config keys.<name>.passphrase <passphrase>
+
+    Encrypted blobs record the name of their key, so anyone with it
+    configured can download them. They are still named (and deduped)
+    by the hash of their plaintext.
+
+    Failed transfers (network errors, server errors, rate limiting)
+    are retried with exponential backoff, resuming downloads where they
+    left off. See retry.{attempts, backoff, maxbackoff}.
+
+    Transfers report their progress (bytes, rate, and ETA): as a
+    progress bar on terminals, and otherwise as periodic log lines.
+    --quiet silences it.
+
+    Transfers can be limited to a total rate (shared by all parallel
+    transfers), with --limit-rate or transfer.limitrate, e.g.:
+
+      > data config transfer.limitrate 2M
 
     (data-blob is part of the plumbing, lower level tools.
     Use it directly if you know what you're doing.)
@@ -83,6 +153,9 @@ var cmd_data_blob = &commander.Command{
 		cmd_data_blob_show,
 		cmd_data_blob_hash,
 		cmd_data_blob_check,
+		cmd_data_blob_stat,
+		cmd_data_blob_gc,
+		cmd_data_blob_sync,
 	},
 }
 
@@ -151,7 +224,7 @@ Arguments:
 }
 
 var cmd_data_blob_show = &commander.Command{
-	UsageLine: "show <hash>",
+	UsageLine: "show [--offset <n>] [--length <n>] <hash>",
 	Short:     "Output blob contents for hash.",
 	Long: `data blob show - Output blob contents for hash.
 
@@ -160,6 +233,15 @@ var cmd_data_blob_show = &commander.Command{
     hashing to verify correctness). Otherwise, it is downloaded
     from the blobstore.
 
+    --offset and --length output only part of the blob, reading only
+    that part from the blobstore (e.g. to sample the header of a large
+    file, without downloading it):
+
+      > data blob show --length 1024 <hash> | head
+
+    Parts of blobs cannot be verified against the blob's hash (though
+    chunks of large blobs are).
+
     See data blob.
 
 Arguments:
@@ -167,7 +249,8 @@ Arguments:
     <hash>   name (cryptographic hash, checksum) of the blob.
 
   `,
-	Run: blobShowCmd,
+	Run:  blobShowCmd,
+	Flag: *flag.NewFlagSet("data-blob-show", flag.ExitOnError),
 }
 
 var cmd_data_blob_hash = &commander.Command{
@@ -209,18 +292,19 @@ Arguments:
 func init() {
 	cmd_data_blob.Flag.Bool("all", false, "all available blobs")
 	cmd_data_blob_get.Flag.Bool("all", false, "get all available blobs")
+	cmd_data_blob_get.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_blob_get.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_blob_get.Flag.String("limit-rate", "", limitRateFlagUsage)
 	cmd_data_blob_put.Flag.Bool("all", false, "put all available blobs")
+	cmd_data_blob_put.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_blob_put.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_blob_put.Flag.String("limit-rate", "", limitRateFlagUsage)
 	cmd_data_blob_url.Flag.Bool("all", false, "urls for all available blobs")
+	cmd_data_blob_show.Flag.Int64("offset", 0, "output from offset (bytes)")
+	cmd_data_blob_show.Flag.Int64("length", -1, "output at most length bytes")
 	cmd_data_blob_check.Flag.Bool("all", false, "check all available blobs")
 }
 
-type blobStore interface {
-	Has(key string) (bool, error)
-	Put(key string, value io.Reader) error
-	Get(key string) (io.ReadCloser, error)
-	Url(key string) string
-}
-
 // map { path : hash } (backward because of dup hashes)
 type blobPaths map[string]string
 
@@ -257,6 +341,10 @@ func blobGetCmd(c *commander.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
 	return getBlobs(blobs)
 }
 
@@ -265,6 +353,10 @@ func blobPutCmd(c *commander.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
 	return putBlobs(blobs)
 }
 
@@ -291,7 +383,19 @@ func blobShowCmd(c *commander.Command, args []string) error {
 		return err
 	}
 
-	return dataIndex.copyBlob(hash, os.Stdout)
+	offset := c.Flag.Lookup("offset").Value.Get().(int64)
+	length := c.Flag.Lookup("length").Value.Get().(int64)
+	if offset < 0 {
+		return fmt.Errorf("%v: invalid offset %d", c.FullName(), offset)
+	}
+	if length < -1 { // -1 (the default) outputs to the end.
+		return fmt.Errorf("%v: invalid length %d", c.FullName(), length)
+	}
+
+	if offset == 0 && length < 0 {
+		return dataIndex.copyBlob(hash, os.Stdout)
+	}
+	return dataIndex.copyBlobRange(hash, offset, length, os.Stdout)
 }
 
 func blobHashCmd(c *commander.Command, args []string) error {
@@ -329,18 +433,26 @@ func putBlobs(blobs blobPaths) error {
 
 	// flip map, to skip dupes
 	flipped := map[string]string{}
+	hashes := []string{}
 	for path, hash := range blobs {
+		if _, dup := flipped[hash]; !dup {
+			hashes = append(hashes, hash)
+		}
 		flipped[hash] = path
 	}
 
-	for hash, path := range flipped {
-		err = dataIndex.putBlob(hash, path)
-		if err != nil {
-			return err
-		}
+	size := int64(0)
+	for _, fpath := range flipped {
+		size += fileSize(fpath)
 	}
 
-	return nil
+	p := startProgress("put blob", len(hashes), size)
+	errs := parallel(len(hashes), dataIndex.Jobs, func(n int) error {
+		hash := hashes[n]
+		return dataIndex.putBlob(hash, flipped[hash])
+	})
+	p.Stop()
+	return newTransferErrors("put blob", len(hashes), errs)
 }
 
 // Downloads all blobs from blobstore
@@ -354,30 +466,59 @@ func getBlobs(blobs blobPaths) error {
 
 	// group map, to copy dupes
 	grouped := map[string][]string{}
+	hashes := []string{}
 	for path, hash := range blobs {
-		g, _ := grouped[hash]
+		g, found := grouped[hash]
+		if !found {
+			hashes = append(hashes, hash)
+		}
 		grouped[hash] = append(g, path)
 	}
 
-	for hash, paths := range grouped {
+	p := startProgress("get blob", len(hashes), blobsSize(grouped))
+	errs := parallel(len(hashes), dataIndex.Jobs, func(n int) error {
+		hash := hashes[n]
+		paths := grouped[hash]
 
 		// download one blob
-		err = dataIndex.getBlob(hash, paths[0])
+		err := dataIndex.getBlob(hash, paths[0])
 		if err != nil {
 			return err
 		}
 
 		// copy what we got to others
 		for _, path := range paths[1:] {
-			pErr("copy blob %.7s %s\n", hash, path)
+			vErr("copy blob %s %s\n", shortHash(hash), path)
 			err := copyFile(paths[0], path)
 			if err != nil {
 				return err
 			}
 		}
-	}
+		return nil
+	})
+	p.Stop()
+	return newTransferErrors("get blob", len(hashes), errs)
+}
 
-	return nil
+// Returns the total size of blobs ({ hash : paths }), as listed in the
+// manifest (or, if not in it, as found locally). -1 if unknown.
+func blobsSize(blobs map[string][]string) int64 {
+	mf := NewDefaultManifest()
+	size := int64(0)
+	for hash, paths := range blobs {
+		e, found := mf.Entry(paths[0])
+		if found && e.Hash == hash {
+			size += e.Size
+			continue
+		}
+
+		fi, err := os.Stat(paths[0])
+		if err != nil {
+			return -1
+		}
+		size += fi.Size()
+	}
+	return size
 }
 
 // Shows all urls for blobs
@@ -420,15 +561,16 @@ func checkBlobs(blobs blobPaths) error {
 	return nil
 }
 
+// (chunked blobs are also named by the hash of their whole contents.)
 func checkBlob(oldHash string, fpath string) (bool, error) {
-	mfmt := "check %.7s %s %s"
+	mfmt := "check %s %s %s"
 
-	newHash, err := hashFile(fpath)
+	newHash, err := hashFileAs(fpath, oldHash)
 	if err != nil {
 		switch err.(type) {
 		case *os.PathError:
 			// non existent files count as not hashing correctly.
-			pErr(mfmt, oldHash, fpath, "FAIL - not found\n")
+			pErr(mfmt, shortHash(oldHash), fpath, "FAIL - not found\n")
 			return false, nil
 		default:
 			return false, err
@@ -436,11 +578,11 @@ func checkBlob(oldHash string, fpath string) (bool, error) {
 	}
 
 	if newHash != oldHash {
-		pErr(mfmt, oldHash, fpath, "FAIL\n")
+		pErr(mfmt, shortHash(oldHash), fpath, "FAIL\n")
 		return false, nil
 	}
 
-	dOut(mfmt, oldHash, fpath, "PASS\n")
+	dOut(mfmt, shortHash(oldHash), fpath, "PASS\n")
 	return true, nil
 }
 
@@ -450,7 +592,7 @@ func (i *DataIndex) putBlob(hash string, fpath string) error {
 	// disallow empty paths
 	// (stdin doesn't make sense when hashing must have already ocurred)
 	if len(fpath) == 0 {
-		return fmt.Errorf("put blob %.7s - error: no path supplied", hash)
+		return fmt.Errorf("put blob %s - error: no path supplied", shortHash(hash))
 	}
 
 	fpath = path.Clean(fpath)
@@ -462,13 +604,14 @@ func (i *DataIndex) putBlob(hash string, fpath string) error {
 	}
 
 	if exists {
-		pErr("put blob %.7s %s - exists\n", hash, fpath)
+		vErr("put blob %s %s - exists\n", shortHash(hash), fpath)
+		currentProgress().skipBlob(fpath)
 		return nil
 	}
 
 	// must verify hash before uploading (for integrity).
 	// (note that there is a TOCTTOU bug here, so not safe. just helps.)
-	vh, err := hashFile(fpath)
+	vh, err := hashFileAs(fpath, hash)
 	if err != nil {
 		return err
 	}
@@ -478,7 +621,21 @@ func (i *DataIndex) putBlob(hash string, fpath string) error {
 		return fmt.Errorf(m, fpath, hash, vh)
 	}
 
-	pErr("put blob %.7s %s - uploading\n", hash, fpath)
+	chunked, err := shouldChunk(fpath)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("put blob %s %s", shortHash(hash), fpath)
+	bp := currentProgress().startBlob(name, fileSize(fpath))
+	defer bp.Done()
+
+	if chunked {
+		vErr("%s - uploading chunks\n", name)
+		return i.putChunkedBlob(hash, fpath, bp)
+	}
+
+	vErr("%s - uploading\n", name)
 
 	f, err := os.Open(fpath)
 	if err != nil {
@@ -486,8 +643,8 @@ func (i *DataIndex) putBlob(hash string, fpath string) error {
 	}
 	defer f.Close()
 
-	bf := bufio.NewReader(f)
-	err = i.BlobStore.Put(BlobKey(hash), bf)
+	// pass the file itself, so blobstores can tell its size.
+	err = i.BlobStore.Put(BlobKey(hash), throttleFile(bp.file(f)))
 	if err != nil {
 		return err
 	}
@@ -505,53 +662,193 @@ func (i *DataIndex) getBlob(hash string, fpath string) error {
 
 	// disallow empty paths
 	if len(fpath) == 0 {
-		return fmt.Errorf("get blob %.7s - error: no path supplied", hash)
+		return fmt.Errorf("get blob %s - error: no path supplied", shortHash(hash))
 	}
 
 	fpath = path.Clean(fpath)
 
-	pErr("get blob %.7s %s\n", hash, fpath)
-	w, err := createFile(fpath)
+	if i.BlobCache != nil {
+		return i.getCachedBlob(hash, fpath)
+	}
+
+	vErr("get blob %s %s\n", shortHash(hash), fpath)
+	pf, err := openPartial(fpath, hash)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	defer pf.Close()
 
-	return i.copyBlob(hash, w)
+	return i.downloadBlob(hash, pf, nil)
 }
 
+// Ensures the blob is in the local cache, and materializes it at fpath.
+func (i *DataIndex) getCachedBlob(hash string, fpath string) error {
+	cached, err := i.BlobCache.Has(hash)
+	if err != nil {
+		return err
+	}
+
+	if cached {
+		vErr("get blob %s %s - cached\n", shortHash(hash), fpath)
+		currentProgress().skipBlob("")
+		return i.BlobCache.Link(hash, fpath)
+	}
+
+	vErr("get blob %s %s\n", shortHash(hash), fpath)
+	cpf, err := openPartial(i.BlobCache.Path(hash), hash)
+	if err != nil {
+		return err
+	}
+	defer cpf.Close()
+
+	r, err := i.openBlobFor(hash, cpf)
+	if err != nil {
+		return err
+	}
+
+	// chunked blobs are cached as chunks. write the file directly.
+	if _, chunked := r.(*chunkedBlobReader); chunked {
+		offset := cpf.Offset
+		cpf.Discard()
+
+		pf, err := openPartial(fpath, hash)
+		if err != nil {
+			r.Close()
+			return err
+		}
+		defer pf.Close()
+
+		if pf.Offset != offset {
+			r.Close()
+			r = nil
+		}
+		return i.downloadBlob(hash, pf, r)
+	}
+
+	err = i.downloadBlob(hash, cpf, r)
+	if err != nil {
+		return err
+	}
+
+	return i.BlobCache.Link(hash, fpath)
+}
+
+// Opens blob for downloading into pf, from where pf left off. If the
+// download cannot be resumed, starts over.
+func (i *DataIndex) openBlobFor(hash string, pf *partialFile) (io.ReadCloser, error) {
+	r, err := i.findBlobFrom(hash, pf.Offset)
+	if err == nil || pf.Offset == 0 {
+		return r, err
+	}
+
+	if _, transient := err.(*TransientError); transient {
+		return nil, err // try again later. no need to start over.
+	}
+
+	dOut("cannot resume %s (%v). starting over.\n", shortHash(hash), err)
+	err = pf.Truncate()
+	if err != nil {
+		return nil, err
+	}
+	return i.findBlobFrom(hash, 0)
+}
+
+// Downloads the rest of the blob into pf (from r, if already open), and
+// commits it. Transient failures are retried, resuming where they left off.
+// (Failed requests are retried where made; see RetryPolicy.Do.)
+func (i *DataIndex) downloadBlob(hash string, pf *partialFile, r io.ReadCloser) error {
+	bp := currentProgress().startBlob("get blob "+shortHash(hash), -1)
+	defer bp.Done()
+
+	return configRetryPolicy().Do(func(attempt int) error {
+		if r == nil {
+			var err error
+			r, err = i.openBlobFor(hash, pf)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := commitBlob(hash, pf, throttle(bp.reader(r, pf.Offset)))
+		r = nil
+		return err
+	})
+}
+
+// Writes the rest of the blob from r into pf, verifies, and commits it.
+// On failure, what was downloaded is kept, to resume later.
+func commitBlob(hash string, pf *partialFile, r io.ReadCloser) error {
+	defer r.Close()
+
+	_, err := io.Copy(pf, r)
+	if err != nil {
+		return verifyErrorFor(netError(err), pf.path)
+	}
+
+	return pf.Commit(hash)
+}
+
+// Copies blob to w. w is closed only if the blob verifies.
 func (i *DataIndex) copyBlob(hash string, w io.WriteCloser) error {
 	r, err := i.findBlob(hash)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	br := bufio.NewReader(r)
+	bp := currentProgress().startBlob("copy blob "+shortHash(hash), -1)
+	defer bp.Done()
+
+	br := bufio.NewReader(throttle(bp.reader(r, 0)))
 	_, err = io.Copy(w, br)
 	if err != nil {
+		if f, ok := w.(*os.File); ok {
+			err = verifyErrorFor(err, f.Name())
+		}
 		return err
 	}
 
-	err = w.Close()
+	return w.Close()
+}
+
+// Copies length bytes of blob, from offset, to w. Parts of blobs cannot
+// be verified as a whole (chunks still are, as they are fetched).
+func (i *DataIndex) copyBlobRange(hash string, offset int64, length int64, w io.Writer) error {
+	r, err := i.findBlobRange(hash, offset, length)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	err = r.Close()
+	_, err = io.Copy(w, bufio.NewReader(throttle(r)))
+	return err
+}
+
+// Opens blob for reading. Its contents are verified as they are read.
+func (i *DataIndex) findBlob(hash string) (io.ReadCloser, error) {
+	r, err := i.findBlobFrom(hash, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return verifyBlob(r, hash)
+}
 
-	return nil
+// Opens blob for reading from offset.
+func (i *DataIndex) findBlobFrom(hash string, offset int64) (io.ReadCloser, error) {
+	return i.findBlobRange(hash, offset, -1)
 }
 
-func (i *DataIndex) findBlob(hash string) (io.ReadCloser, error) {
+// Opens length bytes of blob, from offset (length < 0 reads to the end).
+// Looks for it in local copies first, then the local cache, then the
+// remote blobstore (packed, whole, or as chunks), reading only the range
+// (and only the chunks) needed.
+func (i *DataIndex) findBlobRange(hash string, offset int64, length int64) (io.ReadCloser, error) {
 
 	mf := NewDefaultManifest()
 	paths := mf.PathsForHash(hash)
 	for _, p := range paths {
 		dOut("found local blob copy. verifying hash. %s\n", p)
-		h, err := hashFile(p)
+		h, err := hashFileAs(p, hash)
 		if err != nil {
 			continue
 		}
@@ -562,17 +859,58 @@ func (i *DataIndex) findBlob(hash string) (io.ReadCloser, error) {
 				continue
 			}
 
-			return f, nil
+			_, err = f.Seek(offset, os.SEEK_SET)
+			if err != nil {
+				f.Close()
+				continue
+			}
+
+			return limitReadCloser(f, length), nil
+		}
+	}
+
+	if i.BlobCache != nil {
+		r, err := i.BlobCache.GetFrom(hash, offset)
+		if err == nil {
+			dOut("found blob in local cache. %s\n", i.BlobCache.Path(hash))
+			return limitReadCloser(r, length), nil
 		}
 	}
 
+	r, err := i.findPackedBlob(hash, offset)
+	if err != nil || r != nil {
+		return limitReadCloser(r, length), err
+	}
+
 	dOut("no local blob copy. fetch from remote blobstore.\n")
-	return i.BlobStore.Get(BlobKey(hash))
+	r, err = getBlobRange(i.BlobStore, BlobKey(hash), offset, length)
+	if err == nil {
+		return r, nil
+	}
+
+	// not stored whole? perhaps it is stored as chunks.
+	ci, cerr := i.getChunkIndex(hash)
+	if cerr != nil || ci == nil {
+		return nil, err
+	}
+
+	dOut("found chunked blob (%d chunks).\n", len(ci.Chunks))
+	return limitReadCloser(newChunkedBlobReader(i, ci, offset), length), nil
 }
 
-// DataIndex extension to check if blob exists
+// DataIndex extension to check if blob exists (whole, as chunks, or
+// packed -- as far as the pack index knows)
 func (i *DataIndex) hasBlob(hash string) (bool, error) {
-	return i.BlobStore.Has(BlobKey(hash))
+	if _, _, packed := i.packIndex().Find(hash); packed {
+		return true, nil
+	}
+
+	exists, err := i.BlobStore.Has(BlobKey(hash))
+	if err != nil || exists {
+		return exists, err
+	}
+
+	return i.BlobStore.Has(ChunkIndexKey(hash))
 }
 
 // DataIndex extension to handle getting blob url
@@ -586,7 +924,7 @@ func allBlobPaths(hash string) ([]string, error) {
 
 	paths := mf.PathsForHash(hash)
 
-	mfh, err := mf.ManifestHash()
+	mfh, err := mf.ManifestHashAs(hash)
 	if err != nil {
 		return []string{}, err
 	}
@@ -600,7 +938,30 @@ func allBlobPaths(hash string) ([]string, error) {
 
 // Returns the blobstore key for blob
 func BlobKey(hash string) string {
-	return fmt.Sprintf("/blob/%s", hash)
+	return hashKey("blob", hash)
+}
+
+// Returns the blobstore key for hash under prefix. sha1 hashes keep
+// their original (untagged) keys: /<prefix>/<digest>. Others are keyed
+// /<prefix>/<algorithm>/<digest>.
+func hashKey(prefix string, hash string) string {
+	algo, digest := splitHash(hash)
+	if algo == HashSha1 {
+		return fmt.Sprintf("/%s/%s", prefix, digest)
+	}
+	return fmt.Sprintf("/%s/%s/%s", prefix, algo, digest)
+}
+
+// Returns the hash keyed by key under prefix (the inverse of hashKey),
+// and whether key is one.
+func keyHash(prefix string, key string) (string, bool) {
+	rest := strings.TrimPrefix(key, "/"+prefix+"/")
+	if rest == key {
+		return "", false
+	}
+
+	hash := strings.Replace(rest, "/", ":", 1)
+	return hash, IsHash(hash)
 }
 
 // Prune out invalid blob paths (bad hashes, bad paths)
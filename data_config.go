@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"strconv"
 	"strings"
 
 	"github.com/gonuts/flag"
@@ -113,6 +114,34 @@ func ConfigGetString(key string, default_ string) string {
 	return fmt.Sprintf("%s", val)
 }
 
+func ConfigGetBool(key string, default_ bool) bool {
+	switch val := ConfigGet(key).(type) {
+	case bool:
+		return val
+	case string: // values set with `data config` are strings.
+		b, err := strconv.ParseBool(val)
+		if err == nil {
+			return b
+		}
+		pErr("data config: %s is not a boolean (%s).\n", key, val)
+	}
+	return default_
+}
+
+func ConfigGetInt(key string, default_ int) int {
+	switch val := ConfigGet(key).(type) {
+	case int:
+		return val
+	case string: // values set with `data config` are strings.
+		i, err := strconv.Atoi(val)
+		if err == nil {
+			return i
+		}
+		pErr("data config: %s is not an integer (%s).\n", key, val)
+	}
+	return default_
+}
+
 func ConfigGet(key string) interface{} {
 	// struct -> map for dynamic walking
 	m := map[interface{}]interface{}{}
@@ -11,6 +11,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/gonuts/flag"
 	"github.com/jbenet/commander"
 )
 
@@ -39,8 +40,19 @@ var cmd_data_get = &commander.Command{
     - Reconstruct Files, listed in Manifest.
     - Install Files, into working directory.
 
+    Manifests listing file sizes (version 2) are checked to fit in the
+    free disk space before downloading, and file permissions (e.g.
+    executable bits) are restored after.
+
   `,
-	Run: getCmd,
+	Run:  getCmd,
+	Flag: *flag.NewFlagSet("data-get", flag.ExitOnError),
+}
+
+func init() {
+	cmd_data_get.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_get.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_get.Flag.String("limit-rate", "", limitRateFlagUsage)
 }
 
 func getCmd(c *commander.Command, args []string) error {
@@ -64,6 +76,10 @@ func getCmd(c *commander.Command, args []string) error {
 			"argument, or add dependencies in a Datafile.", c.FullName())
 	}
 
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
 	installed_datasets := []string{}
 	for _, ds := range datasets {
 		ds, err := GetDataset(ds)
@@ -163,7 +179,7 @@ func (d *DataIndex) handleRef(h *Handle) (string, error) {
 	// Fetch refs first.
 	err := ri.FetchRefs(false)
 	if err != nil {
-		if strings.Contains(err.Error(), "404 page not found") {
+		if _, notFound := err.(*NotFoundError); notFound {
 			return "", fmt.Errorf("Error: %v not found.", h.Dataset())
 		}
 		return "", fmt.Errorf("Error finding manifest for %v. %s", h.Dataset(), err)
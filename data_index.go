@@ -8,18 +8,32 @@ package data
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 )
 
 type DataIndex struct {
-	Name string
-	Http *HttpClient
+	Name      string
+	Http      *HttpClient
+	BlobStore blobStore
 
-	// For now, use S3Store directly. clean up interface later.
-	// BlobStore blobStore
-	BlobStore *S3Store
+	// The blobstore as stored (below encryption, and codecs), and the
+	// encryption key (name) and codec blobs are put with. See packfiles.
+	rawStore blobStore
+	key      string
+	codec    string
+
+	// Local cache of downloaded blobs. nil if disabled.
+	BlobCache *BlobCache
+
+	// Number of concurrent blob transfers.
+	Jobs int
+
+	// Pack index of the dataset in the working directory. See packIndex.
+	packs   *PackIndex
+	packsLk sync.Mutex
 }
 
 var mainDataIndex *DataIndex
@@ -33,7 +47,7 @@ func NewMainDataIndex() (*DataIndex, error) {
 		return mainDataIndex, nil
 	}
 
-	i := &DataIndex{Name: mainIndexName}
+	i := &DataIndex{Name: mainIndexName, Jobs: configJobs()}
 	err := error(nil)
 
 	i.Http, err = NewHttpClient(i.Name)
@@ -41,7 +55,32 @@ func NewMainDataIndex() (*DataIndex, error) {
 		return nil, err
 	}
 
-	i.BlobStore, err = NewS3Store("datadex.archives", i)
+	i.BlobStore, err = newBlobStore(configBlobStore(i.Name), i)
+	if err != nil {
+		return nil, err
+	}
+
+	i.rawStore = i.BlobStore
+
+	// encrypt new blobs with the dataset's key, if any. (commands run
+	// outside a dataset have no Datafile, and no key.)
+	df, err := NewDefaultDatafile()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %v", DatafileName, err)
+	}
+	i.key = df.Key
+	i.BlobStore, err = newCryptStore(i.BlobStore, i.key)
+	if err != nil {
+		return nil, err
+	}
+
+	i.codec = configBlobCodec(i.Name)
+	i.BlobStore, err = newCodecStore(i.BlobStore, i.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	i.BlobCache, err = configBlobCache()
 	if err != nil {
 		return nil, err
 	}
@@ -103,8 +142,7 @@ func (h *HttpClient) Get(path string) (*http.Response, error) {
 		return nil, err
 	}
 
-	req.Header.Add(HttpHeaderToken, h.AuthToken)
-	req.Header.Add(HttpHeaderUser, h.User)
+	h.AddAuthHeaders(req)
 	return h.DoRequest(req)
 }
 
@@ -126,25 +164,16 @@ func (h *HttpClient) Post(path string, body interface{}) (*http.Response, error)
 	}
 
 	req.Header.Add(HttpHeaderContentType, HttpHeaderContentTypeYaml)
+	h.AddAuthHeaders(req)
+	return h.DoRequest(req)
+}
+
+// Adds the user credentials headers to req.
+func (h *HttpClient) AddAuthHeaders(req *http.Request) {
 	req.Header.Add(HttpHeaderToken, h.AuthToken)
 	req.Header.Add(HttpHeaderUser, h.User)
-	return h.DoRequest(req)
 }
 
 func (h *HttpClient) DoRequest(req *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-
-	c := resp.StatusCode
-	if 200 <= c && c < 400 {
-		return resp, nil
-	}
-
-	e, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	s := strings.TrimSpace(string(e[:]))
-	return nil, fmt.Errorf("HTTP error status code: %d (%s)", c, s)
+	return httpDo(req)
 }
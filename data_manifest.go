@@ -10,7 +10,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gonuts/flag"
 	"github.com/jbenet/commander"
@@ -32,7 +36,14 @@ var cmd_data_manifest = &commander.Command{
     Running data-manifest without arguments will generate (or patch)
     the manifest. Note that already hashed files will not be re-hashed
     unless forced to. Some files may be massive, and hashing every run
-    would be prohibitively expensive.
+    would be prohibitively expensive. Files modified since they were
+    hashed (their size, mtime, or inode changed, as recorded in the
+    stat cache, .data/StatCache) are rehashed, as are files not in it.
+    Datasets without a stat cache yet (hashed before it existed) are not
+    rehashed: their checksums are trusted, and recorded, once.
+
+    Files are hashed in parallel, on as many workers as cores, unless
+    set by the hash.jobs config option.
 
     Commands:
 
@@ -43,11 +54,22 @@ var cmd_data_manifest = &commander.Command{
 
     (use the --all flag to do it to all available files)
 
+    Files matching the patterns in .dataignore (gitignore-style globs,
+    one per line; ** matches any directories, a trailing / only
+    directories, and ! re-includes files) are not added by data manifest
+    or add --all. Hidden files and datasets/ are ignored unless
+    re-included. Already tracked files stay tracked until removed.
+
     Loosely, data-manifest's process is:
 
     - List all files in the working directory.
     - Add files to the manifest (effectively tracking them).
     - Hash tracked files, adding checksums to the manifest.
+
+    The manifest records each file's checksum, size, permissions, and
+    media type (if known). Manifests in the legacy format (checksums
+    only) are upgraded once their files change: unchanged (e.g. already
+    published) manifests keep their checksum.
   `,
 	Run: manifestCmd,
 	Subcommands: []*commander.Command{
@@ -175,7 +197,11 @@ func manifestAddCmd(c *commander.Command, args []string) error {
 	// Use all files available if --all is passed in.
 	all := c.Flag.Lookup("all").Value.Get().(bool)
 	if all {
-		paths = listAllFiles(".")
+		var err error
+		paths, err = listAllFiles(".")
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(paths) < 1 {
@@ -183,14 +209,15 @@ func manifestAddCmd(c *commander.Command, args []string) error {
 	}
 
 	// add files to manifest file
-	for _, f := range paths {
-		err := mf.Add(f)
-		if err != nil {
-			return err
+	return mf.Batch(func() error {
+		for _, f := range paths {
+			err := mf.Add(f)
+			if err != nil {
+				return err
+			}
 		}
-	}
-
-	return nil
+		return nil
+	})
 }
 
 func manifestRmCmd(c *commander.Command, args []string) error {
@@ -202,14 +229,15 @@ func manifestRmCmd(c *commander.Command, args []string) error {
 	}
 
 	// remove files from manifest file
-	for _, f := range paths {
-		err := mf.Remove(f)
-		if err != nil {
-			return err
+	return mf.Batch(func() error {
+		for _, f := range paths {
+			err := mf.Remove(f)
+			if err != nil {
+				return err
+			}
 		}
-	}
-
-	return nil
+		return nil
+	})
 }
 
 func manifestHashCmd(c *commander.Command, args []string) error {
@@ -221,14 +249,9 @@ func manifestHashCmd(c *commander.Command, args []string) error {
 	}
 
 	// hash files in manifest file
-	for _, f := range paths {
-		err := mf.Hash(f)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return mf.Batch(func() error {
+		return mf.HashAll(paths)
+	})
 }
 
 func manifestCheckCmd(c *commander.Command, args []string) error {
@@ -252,6 +275,11 @@ func manifestCheckCmd(c *commander.Command, args []string) error {
 		}
 	}
 
+	err = mf.statCache().Flush()
+	if err != nil {
+		return err
+	}
+
 	if failed > 0 {
 		return fmt.Errorf("data manifest check: %d/%d checksums failed.",
 			failed, len(paths))
@@ -263,14 +291,30 @@ func manifestCheckCmd(c *commander.Command, args []string) error {
 type Manifest struct {
 	SerializedFile "-"
 	Files          blobPaths ""
+	Version        int       "-" // see ManifestVersion
+
+	entries map[string]ManifestEntry // file metadata. see Entry.
+	stats   *StatCache               // see statCache
+	legacy  blobPaths                // files as read, if legacy. see upgrade.
+
+	// batched changes. see Begin.
+	batch      int       // Begin depth
+	dirty      bool      // unsaved changes
+	checkpoint time.Time // last save
 }
 
+// Interval between saves of batched changes (see Begin), so long runs
+// (e.g. hashing many files) lose little work if interrupted.
+const ManifestCheckpointInterval = 30 * time.Second
+
 func NewManifest(path string) *Manifest {
 	mf := &Manifest{SerializedFile: SerializedFile{Path: path}}
 
-	// initialize map
+	// initialize maps
 	mf.Files = blobPaths{}
-	mf.SerializedFile.Format = mf.Files
+	mf.entries = map[string]ManifestEntry{}
+	mf.Version = ManifestVersion
+	mf.SerializedFile.Format = mf
 
 	// attempt to load
 	if len(path) > 0 {
@@ -283,6 +327,100 @@ func NewDefaultManifest() *Manifest {
 	return NewManifest(ManifestFileName)
 }
 
+// Returns the stat cache of the manifest's files, kept alongside it (in
+// memory only, for manifests not read from a file).
+func (mf *Manifest) statCache() *StatCache {
+	if mf.stats == nil {
+		path := ""
+		if len(mf.Path) > 0 {
+			path = filepath.Join(filepath.Dir(mf.Path), filepath.Base(StatCacheFileName))
+		}
+		mf.stats = NewStatCache(path)
+	}
+	return mf.stats
+}
+
+// Begins batching changes: Add, Remove, and Hash save the manifest (and
+// its stat cache) only at checkpoints and on Commit, instead of after
+// every change. Begin/Commit pairs nest.
+func (mf *Manifest) Begin() {
+	if mf.batch == 0 {
+		mf.checkpoint = time.Now()
+	}
+	mf.batch++
+}
+
+// Ends a batch of changes (see Begin), saving them.
+func (mf *Manifest) Commit() error {
+	if mf.batch > 0 {
+		mf.batch--
+	}
+
+	if mf.batch > 0 || !(mf.dirty || mf.statCache().changed) {
+		return nil
+	}
+	return mf.save()
+}
+
+// Runs fn in a batch of changes (see Begin). Commits even if fn fails.
+func (mf *Manifest) Batch(fn func() error) error {
+	mf.Begin()
+	err := fn()
+	if cerr := mf.Commit(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Records a change, saving it unless batching (see Begin).
+func (mf *Manifest) changed() error {
+	mf.dirty = true
+	if mf.batch > 0 && time.Since(mf.checkpoint) < ManifestCheckpointInterval {
+		return nil
+	}
+	return mf.save()
+}
+
+// Saves the stat cache, then the manifest. (If interrupted in between,
+// cached hashes that differ from the manifest's get the files rehashed.)
+func (mf *Manifest) save() error {
+	err := mf.statCache().Flush()
+	if err != nil {
+		return err
+	}
+
+	mf.upgrade()
+	err = mf.WriteFile()
+	if err != nil {
+		return err
+	}
+
+	mf.dirty = false
+	mf.checkpoint = time.Now()
+	return nil
+}
+
+// Upgrades a legacy manifest, once its files changed (a new version).
+// Unchanged ones are written as read, keeping their hash (e.g. published).
+func (mf *Manifest) upgrade() {
+	if mf.Version >= ManifestVersion {
+		return
+	}
+
+	changed := len(mf.Files) != len(mf.legacy)
+	for path, hash := range mf.Files {
+		if mf.legacy[path] != hash {
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		pErr("data manifest: upgrading to version %d\n", ManifestVersion)
+		mf.Version = ManifestVersion
+	}
+}
+
 func NewManifestWithRef(ref string) (*Manifest, error) {
 	f := NewManifest("")
 	err := f.ReadBlob(ref)
@@ -293,11 +431,25 @@ func NewManifestWithRef(ref string) (*Manifest, error) {
 }
 
 func (mf *Manifest) Generate() error {
+	return mf.Batch(mf.generate)
+}
+
+func (mf *Manifest) generate() error {
 	pErr("Generating Manifest file...\n")
 
-	// add new files to manifest file
-	// (for now add everything. `data manifest {add,rm}` in future)
-	for _, f := range listAllFiles(".") {
+	// add new files to manifest file, except ignored ones (see
+	// IgnoreFileName). already tracked files stay, until removed.
+	files, err := listAllFiles(".")
+	if err != nil {
+		return err
+	}
+
+	// the pack index is metadata (in .data/), but downloaders need it.
+	if _, err := os.Stat(PacksFileName); err == nil {
+		files = append(files, PacksFileName)
+	}
+
+	for _, f := range files {
 		err := mf.Add(f)
 		if err != nil {
 			return err
@@ -308,15 +460,30 @@ func (mf *Manifest) Generate() error {
 	// (basically, missing things. User removes individually, or `rm --missing`)
 
 	// Once all files are listed, hash all the files, storing the hashes.
+	// Files modified since hashed (see StatCache) are rehashed.
+	sc := mf.statCache()
+	sc.Prune(mf.Files)
+	if sc.missing {
+		sc.Seed(mf.Files)
+	}
+	paths := []string{}
 	for f, h := range mf.Files {
 		if IsHash(h) && h != noHash {
-			continue
+			if !sc.Modified(f, h) {
+				mf.fillEntry(f, h)
+				continue
+			}
+			if _, cached := sc.Files[f]; cached {
+				pErr("data manifest: modified %s\n", f)
+			}
 		}
+		paths = append(paths, f)
+	}
 
-		err := mf.Hash(f)
-		if err != nil {
-			return err
-		}
+	sort.Strings(paths)
+	err = mf.HashAll(paths)
+	if err != nil {
+		return err
 	}
 
 	if len(mf.Files) == 0 {
@@ -337,8 +504,9 @@ func (mf *Manifest) Generate() error {
 func (mf *Manifest) Clear() error {
 	for f, _ := range mf.Files {
 		delete(mf.Files, f)
+		delete(mf.entries, f)
 	}
-	return mf.WriteFile()
+	return mf.changed()
 }
 
 func (mf *Manifest) Add(path string) error {
@@ -350,8 +518,8 @@ func (mf *Manifest) Add(path string) error {
 
 	(mf.Files)[path] = noHash
 
-	// Write out file (store incrementally)
-	err := mf.WriteFile()
+	// Write out file (store incrementally, unless batching)
+	err := mf.changed()
 	if err != nil {
 		return err
 	}
@@ -368,9 +536,11 @@ func (mf *Manifest) Remove(path string) error {
 	}
 
 	delete(mf.Files, path)
+	delete(mf.entries, path)
+	mf.statCache().Remove(path)
 
-	// Write out file (store incrementally)
-	err := mf.WriteFile()
+	// Write out file (store incrementally, unless batching)
+	err := mf.changed()
 	if err != nil {
 		return err
 	}
@@ -379,53 +549,265 @@ func (mf *Manifest) Remove(path string) error {
 	return nil
 }
 
+// Number of files hashed in parallel, unless set by the hash.jobs config
+// option.
+func configHashJobs() int {
+	return ConfigGetInt("hash.jobs", runtime.NumCPU())
+}
+
 func (mf *Manifest) Hash(path string) error {
-	h, err := hashFile(path)
-	if err != nil {
-		return err
+	return mf.HashAll([]string{path})
+}
+
+// Hashes the files at paths in parallel (see configHashJobs). The hashes
+// are recorded (and reported) in order of paths, by the calling goroutine.
+func (mf *Manifest) HashAll(paths []string) error {
+	type result struct {
+		fi   os.FileInfo
+		hash string
+		err  error
 	}
+	results := make([]result, len(paths))
+
+	return orderedParallel(len(paths), configHashJobs(), func(n int) {
+		r := &results[n]
+
+		// stat before hashing: changes while hashing show up next time.
+		r.fi, r.err = os.Stat(paths[n])
+		if r.err == nil {
+			r.hash, r.err = hashFile(paths[n])
+		}
+	}, func(n int) error {
+		r := results[n]
+		if r.err != nil {
+			return r.err
+		}
+		return mf.setHash(paths[n], r.hash, r.fi)
+	})
+}
 
+// Records that the file at path (as stat-ed by fi, before hashing) hashed
+// to h.
+func (mf *Manifest) setHash(path string, h string, fi os.FileInfo) error {
 	(mf.Files)[path] = h
+	mf.entries[path] = newManifestEntry(path, h, fi)
+	mf.statCache().Set(path, h, fi)
 
-	// Write out file (store incrementally)
-	err = mf.WriteFile()
+	// Write out file (store incrementally, unless batching)
+	err := mf.changed()
 	if err != nil {
 		return err
 	}
 
-	pErr("data manifest: hashed %.7s %s\n", h, path)
+	pErr("data manifest: hashed %s %s\n", shortHash(h), path)
 	return nil
 }
 
-func (mf *Manifest) Check(path string) (bool, error) {
-	oldHash, found := (mf.Files)[path]
-	if !found {
-		return false, fmt.Errorf("data manifest: file not in manifest %s", path)
+// Fills in the metadata of the (hashed, unmodified) file at path, if
+// missing (e.g. upgraded from a legacy manifest) or stale (chmod changes
+// neither contents nor mtime).
+func (mf *Manifest) fillEntry(path string, h string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
 	}
 
-	mfmt := "data manifest: check %.7s %s %s"
+	e, found := mf.entries[path]
+	if found && e.FileMode() == fi.Mode().Perm() {
+		return
+	}
 
-	newHash, err := hashFile(path)
-	if err != nil {
-		switch err.(type) {
+	mf.entries[path] = newManifestEntry(path, h, fi)
+	mf.dirty = true
+}
+
+// The result of checking a file against its hash in the manifest.
+type fileCheck struct {
+	path    string
+	oldHash string
+	newHash string
+	fi      os.FileInfo // before hashing. see HashAll.
+	fresh   bool        // unchanged since hashed (see StatCache), not rehashed.
+	err     error
+}
+
+// Hashes the file at path, to check it against oldHash. If cached (its
+// stat cache entry) is given, unchanged files are not rehashed. Safe to
+// call in parallel.
+func checkFile(path string, oldHash string, cached *FileStat) *fileCheck {
+	c := &fileCheck{path: path, oldHash: oldHash}
+	c.fi, _ = os.Stat(path)
+	if cached != nil && c.fi != nil && cached.Unchanged(oldHash, c.fi) {
+		c.fresh = true
+		return c
+	}
+
+	c.newHash, c.err = hashFileAs(path, oldHash)
+	return c
+}
+
+// Reports check c, recording passing files in the stat cache.
+func (mf *Manifest) checked(c *fileCheck) (bool, error) {
+	mfmt := "data manifest: check %s %s %s"
+
+	if c.fresh {
+		dOut(mfmt, shortHash(c.oldHash), c.path, "PASS - unchanged\n")
+		return true, nil
+	}
+
+	if c.err != nil {
+		switch c.err.(type) {
 		case *os.PathError:
 			// non existent files count as not hashing correctly.
-			pErr(mfmt, oldHash, path, "FAIL - not found\n")
+			pErr(mfmt, shortHash(c.oldHash), c.path, "FAIL - not found\n")
 			return false, nil
 		default:
-			return false, err
+			return false, c.err
 		}
 	}
 
-	if newHash != oldHash {
-		pErr(mfmt, oldHash, path, "FAIL\n")
+	if c.newHash != c.oldHash {
+		pErr(mfmt, shortHash(c.oldHash), c.path, "FAIL\n")
 		return false, nil
 	}
 
-	dOut(mfmt, oldHash, path, "PASS\n")
+	if c.fi != nil {
+		mf.statCache().Set(c.path, c.oldHash, c.fi)
+	}
+
+	dOut(mfmt, shortHash(c.oldHash), c.path, "PASS\n")
 	return true, nil
 }
 
+func (mf *Manifest) Check(path string) (bool, error) {
+	oldHash, found := (mf.Files)[path]
+	if !found {
+		return false, fmt.Errorf("data manifest: file not in manifest %s", path)
+	}
+
+	return mf.checked(checkFile(path, oldHash, nil))
+}
+
+// Like Check, but passes files unchanged (see StatCache) without hashing.
+func (mf *Manifest) QuickCheck(path string) (bool, error) {
+	failed, err := mf.CheckAll([]string{path}, true)
+	return failed == 0 && err == nil, err
+}
+
+// Checks the files at paths in parallel (see configHashJobs), reporting
+// in order of paths. With quick, files unchanged since hashed (see
+// StatCache) are not rehashed. Returns the number of files failing.
+func (mf *Manifest) CheckAll(paths []string, quick bool) (int, error) {
+	oldHashes := make([]string, len(paths))
+	cached := make([]FileStat, len(paths))
+	for n, path := range paths {
+		oldHash, found := (mf.Files)[path]
+		if !found {
+			return 0, fmt.Errorf("data manifest: file not in manifest %s", path)
+		}
+
+		// copied: workers must not read the cache while it is updated.
+		oldHashes[n] = oldHash
+		cached[n] = mf.statCache().Files[path]
+	}
+
+	failed := 0
+	checks := make([]*fileCheck, len(paths))
+	err := orderedParallel(len(paths), configHashJobs(), func(n int) {
+		var c *FileStat
+		if quick {
+			c = &cached[n]
+		}
+		checks[n] = checkFile(paths[n], oldHashes[n], c)
+	}, func(n int) error {
+		pass, err := mf.checked(checks[n])
+		if err == nil && !pass {
+			failed++
+		}
+		return err
+	})
+	return failed, err
+}
+
+// Returns the blobs of the dataset described by mf (named ref): its files,
+// and the manifest itself.
+func (mf *Manifest) BlobPaths(ref string) blobPaths {
+	blobs := validBlobHashes(mf.Files)
+	blobs[ManifestFileName] = ref
+	return blobs
+}
+
+// The blobstore objects composing a dataset version.
+type manifestObjects struct {
+	Data    []string // keys of blobs, chunks, and packfiles
+	Indexes []string // keys of chunk indexes, and the manifest
+}
+
+// DataIndex extension to find the blobstore objects composing the dataset
+// described by mf (named ref). Reads its pack index and chunk indexes.
+func (i *DataIndex) manifestObjects(mf *Manifest, ref string) (*manifestObjects, error) {
+	blobs := mf.BlobPaths(ref)
+	objs := &manifestObjects{}
+
+	packed := map[string]bool{}
+	if hash, found := blobs[PacksFileName]; found {
+		pi := NewPackIndex("")
+		err := pi.ReadBlobFrom(i, hash)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading pack index %s. %s", shortHash(hash), err)
+		}
+
+		for _, p := range pi.Packs {
+			objs.Data = append(objs.Data, PackKey(p.Hash))
+			for _, b := range p.Blobs {
+				packed[b.Hash] = true
+			}
+		}
+	}
+
+	hashes := []string{}
+	for path, hash := range blobs {
+		switch {
+		case path == ManifestFileName:
+			objs.Indexes = append(objs.Indexes, BlobKey(hash))
+		case !packed[hash]:
+			hashes = append(hashes, hash)
+		}
+	}
+	hashes = set(hashes)
+
+	// blobs are stored whole, or as chunks.
+	var lk sync.Mutex
+	errs := parallel(len(hashes), i.Jobs, func(n int) error {
+		ci, err := i.getChunkIndex(hashes[n])
+		if err != nil {
+			return err
+		}
+
+		lk.Lock()
+		defer lk.Unlock()
+
+		if ci == nil {
+			objs.Data = append(objs.Data, BlobKey(hashes[n]))
+			return nil
+		}
+
+		for _, c := range ci.Chunks {
+			objs.Data = append(objs.Data, BlobKey(c.Hash))
+		}
+		objs.Indexes = append(objs.Indexes, ChunkIndexKey(hashes[n]))
+		return nil
+	})
+
+	err := newTransferErrors("find chunks", len(hashes), errs)
+	if err != nil {
+		return nil, err
+	}
+
+	objs.Data = set(objs.Data)
+	return objs, nil
+}
+
 func (mf *Manifest) PathsForHash(hash string) []string {
 	l := []string{}
 	for path, h := range mf.Files {
@@ -487,22 +869,31 @@ func (mf *Manifest) Complete() bool {
 	return true
 }
 
-func listAllFiles(path string) []string {
+// Lists the files of the dataset in root, leaving out those ignored (see
+// IgnoreFileName), the dataset's own metadata (.data/), and unfinished
+// downloads.
+func listAllFiles(root string) ([]string, error) {
+	ig, err := NewDirIgnore(root)
+	if err != nil {
+		return nil, fmt.Errorf("data manifest: reading %s: %v", IgnoreFileName, err)
+	}
 
 	files := []string{}
 	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 
-		if info.IsDir() {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
 
-			// entirely skip hidden dirs
-			if len(info.Name()) > 1 && strings.HasPrefix(info.Name(), ".") {
-				dOut("data manifest: skipping %s/\n", info.Name())
-				return filepath.SkipDir
-			}
+		if info.IsDir() {
 
-			// skip datasets/
-			if path == DatasetDir {
-				dOut("data manifest: skipping %s/\n", info.Name())
+			// entirely skip metadata, and ignored dirs
+			if rel == filepath.Dir(ManifestFileName) || ig.Ignored(rel, true) {
+				dOut("data manifest: skipping %s/\n", rel)
 				return filepath.SkipDir
 			}
 
@@ -510,15 +901,15 @@ func listAllFiles(path string) []string {
 			return nil
 		}
 
-		// skip manifest file
-		if path == ManifestFileName {
-			dOut("data manifest: skipping %s\n", info.Name())
+		// skip ignored files
+		if ig.Ignored(rel, false) {
+			dOut("data manifest: skipping %s\n", rel)
 			return nil
 		}
 
-		// skip hidden files
-		if strings.HasPrefix(info.Name(), ".") {
-			dOut("data manifest: skipping %s\n", info.Name())
+		// skip unfinished downloads
+		if strings.HasSuffix(info.Name(), PartialSuffix) {
+			dOut("data manifest: skipping %s\n", rel)
 			return nil
 		}
 
@@ -526,16 +917,26 @@ func listAllFiles(path string) []string {
 		return nil
 	}
 
-	filepath.Walk(path, walkFn)
-	return files
+	err = filepath.Walk(root, walkFn)
+	return files, err
 }
 
 func (mf *Manifest) ManifestHash() (string, error) {
+	return mf.manifestHashAlgo(DefaultHashAlgorithm)
+}
+
+// Returns the manifest hash, computed with the same algorithm as hash.
+// Use this to compare against existing (perhaps sha1) manifest refs.
+func (mf *Manifest) ManifestHashAs(hash string) (string, error) {
+	return mf.manifestHashAlgo(hashAlgorithm(hash))
+}
+
+func (mf *Manifest) manifestHashAlgo(algo string) (string, error) {
 	buf, err := mf.Marshal()
 	if err != nil {
 		return "", err
 	}
 
 	r := bytes.NewReader(buf)
-	return readerHash(r)
+	return readerHashAlgo(r, algo)
 }
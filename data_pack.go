@@ -9,7 +9,8 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"strings"
+	"sort"
+	"sync"
 
 	"github.com/gonuts/flag"
 	"github.com/jbenet/commander"
@@ -28,6 +29,7 @@ var cmd_data_pack = &commander.Command{
       pack download   Download package from remote storage.
       pack publish    Publish package to dataset index.
       pack checksum   Verify all file checksums match.
+      pack stats      Show package storage statistics.
 
 
   What is a data package?
@@ -57,7 +59,8 @@ var cmd_data_pack = &commander.Command{
     Packages, once 'packed' (Datafile + Manifest created), can be uploaded
     to a remote storage service (by default, the datadex). This means
     uploading all the package's files (blobs) not already present in the
-    storage service. This is determined using a checksum.
+    storage service. This is determined using a checksum. With --pack,
+    small files are bundled into packfiles, uploaded as few objects.
 
   data pack download
 
@@ -76,6 +79,11 @@ var cmd_data_pack = &commander.Command{
 
     Packages can be verified entirely by calling the 'data pack checksum'
     command. It re-hashes every file and ensures the checksums match.
+
+  data pack stats
+
+    Shows how much blobstore storage the package's published versions
+    take up, and how much of it is shared (deduplicated) between them.
   `,
 
 	Subcommands: []*commander.Command{
@@ -85,6 +93,7 @@ var cmd_data_pack = &commander.Command{
 		cmd_data_pack_download,
 		cmd_data_pack_publish,
 		cmd_data_pack_check,
+		cmd_data_pack_stats,
 	},
 }
 
@@ -127,9 +136,16 @@ var cmd_data_pack_upload = &commander.Command{
     file, avoiding redundant uploads, saving bandwidth, and leveraging
     the data uploaded along with other datasets.
 
+    With --pack, small files (under 256KiB) are bundled into packfiles,
+    rather than each uploaded as its own object. This makes datasets of
+    many tiny files much faster to upload. The pack index (which files
+    are in which packfile) is stored in .data/Packs, tracked in the
+    Manifest. Downloads read packed files out of their packfiles.
+
     See 'data pack'.
   `,
-	Run: packUploadCmd,
+	Run:  packUploadCmd,
+	Flag: *flag.NewFlagSet("data-pack-upload", flag.ExitOnError),
 }
 
 var cmd_data_pack_download = &commander.Command{
@@ -145,7 +161,8 @@ var cmd_data_pack_download = &commander.Command{
 
     See 'data pack'.
   `,
-	Run: packDownloadCmd,
+	Run:  packDownloadCmd,
+	Flag: *flag.NewFlagSet("data-pack-download", flag.ExitOnError),
 }
 
 var cmd_data_pack_publish = &commander.Command{
@@ -175,14 +192,29 @@ var cmd_data_pack_check = &commander.Command{
     checksums FAIL, it is suggested that the files be re-downloaded (using
     'data pack download' or 'data blob get <hash>').
 
+    With --quick, files unchanged since last hashed (same size, mtime, and
+    inode, per the stat cache) are not rehashed.
+
     See 'data pack'.
   `,
-	Run: packCheckCmd,
+	Run:  packCheckCmd,
+	Flag: *flag.NewFlagSet("data-pack-check", flag.ExitOnError),
 }
 
 func init() {
 	cmd_data_pack_make.Flag.Bool("clean", false, "make pack from scratch")
+	cmd_data_pack_check.Flag.Bool("quick", false, "skip files unchanged since hashed")
+	cmd_data_pack_upload.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_pack_upload.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_pack_upload.Flag.String("limit-rate", "", limitRateFlagUsage)
+	cmd_data_pack_upload.Flag.Bool("pack", false, "bundle small files into packfiles")
+	cmd_data_pack_download.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_pack_download.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_pack_download.Flag.String("limit-rate", "", limitRateFlagUsage)
 	cmd_data_pack_publish.Flag.Bool("force", false, "overwrite published version")
+	cmd_data_pack_publish.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_pack_publish.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_pack_publish.Flag.String("limit-rate", "", limitRateFlagUsage)
 }
 
 func packMakeCmd(c *commander.Command, args []string) error {
@@ -214,7 +246,11 @@ func packUploadCmd(c *commander.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	return p.Upload()
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+	return p.Upload(c.Flag.Lookup("pack").Value.Get().(bool))
 }
 
 func packDownloadCmd(c *commander.Command, args []string) error {
@@ -222,6 +258,10 @@ func packDownloadCmd(c *commander.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
 	return p.Download()
 }
 
@@ -231,10 +271,14 @@ func packPublishCmd(c *commander.Command, args []string) error {
 		return err
 	}
 
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
 	force := c.Flag.Lookup("force").Value.Get().(bool)
 	err = p.Publish(force)
 	if err != nil {
-		if strings.Contains(err.Error(), "forbidden") {
+		if _, forbidden := err.(*ForbiddenError); forbidden {
 			u := configUser()
 			d := p.datafile.Handle().Path()
 			o := p.datafile.Handle().Author
@@ -256,17 +300,18 @@ func packCheckCmd(c *commander.Command, args []string) error {
 		pErr("Warning: manifest incomplete. Checksums may be incorrect.")
 	}
 
-	failures := 0
+	quick := c.Flag.Lookup("quick").Value.Get().(bool)
+	paths := p.manifest.AllPaths()
+	sort.Strings(paths)
 
-	for _, file := range p.manifest.AllPaths() {
-		pass, err := p.manifest.Check(file)
-		if err != nil {
-			return err
-		}
+	failures, err := p.manifest.CheckAll(paths, quick)
+	if err != nil {
+		return err
+	}
 
-		if !pass {
-			failures++
-		}
+	err = p.manifest.statCache().Flush()
+	if err != nil {
+		return err
 	}
 
 	count := len(p.manifest.Files)
@@ -305,9 +350,7 @@ func (p *Pack) BlobPaths() (blobPaths, error) {
 		return blobPaths{}, err
 	}
 
-	blobs := validBlobHashes(p.manifest.Files)
-	blobs[p.manifest.Path] = mfh
-	return blobs, nil
+	return p.manifest.BlobPaths(mfh), nil
 }
 
 func (p *Pack) Make(clean bool) error {
@@ -357,26 +400,48 @@ func (p *Pack) blobsToUpload() ([]string, error) {
 		return []string{}, err
 	}
 
+	hashes := []string{}
 	for _, hash := range blobs {
-		exists, err := p.index.hasBlob(hash)
+		hashes = append(hashes, hash)
+	}
+	hashes = set(hashes)
+
+	var lk sync.Mutex
+	errs := parallel(len(hashes), p.index.Jobs, func(n int) error {
+		exists, err := p.index.hasBlob(hashes[n])
 		if err != nil {
-			return []string{}, err
+			return err
 		}
 
 		if !exists {
-			dOut("blobstore missing %s\n", hash)
-			missing = append(missing, hash)
+			dOut("blobstore missing %s\n", hashes[n])
+			lk.Lock()
+			missing = append(missing, hashes[n])
+			lk.Unlock()
 		}
+		return nil
+	})
+
+	err = newTransferErrors("has blob", len(hashes), errs)
+	if err != nil {
+		return []string{}, err
 	}
 	return missing, nil
 }
 
-// Uploads pack to index.
-func (p *Pack) Upload() error {
+// Uploads pack to index. Small blobs are uploaded in packfiles if packed.
+func (p *Pack) Upload(packed bool) error {
 	if !p.manifest.Complete() {
 		return fmt.Errorf(ManifestIncompleteMsg)
 	}
 
+	if packed {
+		err := p.uploadPackfiles()
+		if err != nil {
+			return err
+		}
+	}
+
 	blobs, err := p.BlobPaths()
 	if err != nil {
 		return err
@@ -385,6 +450,38 @@ func (p *Pack) Upload() error {
 	return putBlobs(blobs)
 }
 
+// Bundles the small blobs missing from the blobstore into packfiles, and
+// tracks the (updated) pack index in the manifest.
+func (p *Pack) uploadPackfiles() error {
+	pi := p.index.packIndex()
+
+	blobs := validBlobHashes(p.manifest.Files)
+	delete(blobs, PacksFileName)
+
+	live := map[string]bool{}
+	for _, hash := range blobs {
+		live[hash] = true
+	}
+	pi.Prune(live)
+
+	err := p.index.putPackedBlobs(blobs, pi)
+
+	_, tracked := p.manifest.Files[PacksFileName]
+	if len(pi.Packs) == 0 && !tracked {
+		return err
+	}
+
+	// record whatever was packed, even on error.
+	if werr := pi.WriteFile(); werr != nil {
+		return werr
+	}
+
+	if herr := p.manifest.Hash(PacksFileName); herr != nil {
+		return herr
+	}
+	return err
+}
+
 // Downloads pack from index.
 func (p *Pack) Download() error {
 	if !p.manifest.Complete() {
@@ -396,7 +493,85 @@ func (p *Pack) Download() error {
 		return err
 	}
 
-	return getBlobs(blobs)
+	err = p.checkDiskSpace()
+	if err != nil {
+		return err
+	}
+
+	// the pack index locates packed blobs. get it first.
+	if hash, found := blobs[PacksFileName]; found {
+		err := getBlobs(blobPaths{PacksFileName: hash})
+		if err != nil {
+			return err
+		}
+
+		p.index.reloadPackIndex()
+		delete(blobs, PacksFileName)
+	}
+
+	err = getBlobs(blobs)
+	if err != nil {
+		return err
+	}
+
+	err = p.restoreModes()
+	if err != nil {
+		return err
+	}
+
+	// the files were just verified: record them, not to rehash them.
+	sc := p.manifest.statCache()
+	sc.Seed(p.manifest.Files)
+	return sc.Flush()
+}
+
+// Checks the files missing from the working directory fit in it. Skipped
+// if the manifest has no sizes (legacy manifests).
+func (p *Pack) checkDiskSpace() error {
+	need := int64(0)
+	for path := range p.manifest.Files {
+		e, found := p.manifest.Entry(path)
+		if !found {
+			return nil
+		}
+
+		// existing files are replaced (or already downloaded).
+		if fi, err := os.Stat(path); err == nil {
+			e.Size -= fi.Size()
+		}
+		if e.Size > 0 {
+			need += e.Size
+		}
+	}
+
+	free, err := diskFree(".")
+	if err != nil {
+		dErr("data pack: cannot check free space: %v\n", err)
+		return nil
+	}
+
+	if need > free {
+		return fmt.Errorf("data pack: not enough disk space. Need %s, have %s.",
+			humanBytes(need), humanBytes(free))
+	}
+	return nil
+}
+
+// Sets the permissions of downloaded files, as in the manifest.
+func (p *Pack) restoreModes() error {
+	for path := range p.manifest.Files {
+		e, _ := p.manifest.Entry(path)
+		mode := e.FileMode()
+		if mode == 0 {
+			continue
+		}
+
+		err := os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Publishes pack to the Index
@@ -435,16 +610,13 @@ func (p *Pack) Publish(force bool) error {
 	ri := p.index.RefIndex(h.Path())
 	ref, err := ri.VersionRef(h.Version)
 	if err != nil {
-		switch {
-		// http errors fail.
-		case strings.Contains(err.Error(), "connection refused"):
+		switch err.(type) {
+		// network errors fail.
+		case *TransientError:
 			return fmt.Errorf(NetErrMsg, p.index.Http.Url)
 
-		// ok if no ref for version.
-		case strings.Contains(err.Error(), "No ref for version"):
-
-		// ok if not found.
-		case strings.Contains(err.Error(), "HTTP error status code: 404"):
+		// ok if not found, or no ref for version.
+		case *NotFoundError:
 
 		default:
 			return err
@@ -452,17 +624,25 @@ func (p *Pack) Publish(force bool) error {
 	}
 
 	if ref != "" {
-		pOut("Found published version %s (%.7s).\n", h.Version, ref)
-		if ref == mfh {
-			pOut(PublishedVersionSameMsg, h.Version, ref)
+		pOut("Found published version %s (%s).\n", h.Version, shortHash(ref))
+
+		// ref may be hashed differently (e.g. sha1 before sha256).
+		same, err := p.manifest.ManifestHashAs(ref)
+		if err != nil {
+			return err
+		}
+
+		if ref == same {
+			pOut(PublishedVersionSameMsg, h.Version, shortHash(ref))
 			return nil
 		}
 
 		if !force {
-			return fmt.Errorf(PublishedVersionDiffersMsg, h.Version, ref, h.Dataset())
+			return fmt.Errorf(PublishedVersionDiffersMsg, h.Version, shortHash(ref), h.Dataset())
 		}
 
-		pOut("Using --force. Overwriting %s (%.7s -> %.7s).\n", h.Version, ref, mfh)
+		pOut("Using --force. Overwriting %s (%s -> %s).\n", h.Version,
+			shortHash(ref), shortHash(mfh))
 	}
 
 	// ok seems good to go.
@@ -471,12 +651,12 @@ func (p *Pack) Publish(force bool) error {
 		return err
 	}
 
-	pOut("data pack: published %s (%.7s).\n", h.Dataset(), mfh)
+	pOut("data pack: published %s (%s).\n", h.Dataset(), shortHash(mfh))
 	pOut("Webpage at %s/%s\n", p.index.Http.BaseUrl, h.Dataset())
 	return nil
 }
 
-const PublishedVersionDiffersMsg = `Version %s (%.7s) already published, but contents differ.
+const PublishedVersionDiffersMsg = `Version %s (%s) already published, but contents differ.
 If you're trying to publish a new version, increment the version
 number in Datafile, and then try again:
 
@@ -487,7 +667,7 @@ you may do so with the '--force' flag. However, this is not advised.
 Make sure you are aware of all side-effects; you might break compatibility
 for everyone else using this dataset. You have been warned.`
 
-const PublishedVersionSameMsg = `Version %s (%.7s) already published.
+const PublishedVersionSameMsg = `Version %s (%s) already published.
 It has the same contents you're trying to publish, so seems like
 your work here is done :)
 `
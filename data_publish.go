@@ -32,6 +32,11 @@ func init() {
 		"rebuild manifest (data pack make --clean)")
 	cmd_data_publish.Flag.Bool("force", false,
 		"force publish (data pack publish --force)")
+	cmd_data_publish.Flag.Bool("pack", false,
+		"bundle small files into packfiles (data pack upload --pack)")
+	cmd_data_publish.Flag.Int("jobs", 0, jobsFlagUsage)
+	cmd_data_publish.Flag.Bool("quiet", false, quietFlagUsage)
+	cmd_data_publish.Flag.String("limit-rate", "", limitRateFlagUsage)
 }
 
 func publishCmd(c *commander.Command, args []string) error {
@@ -156,7 +156,7 @@ func (h *HttpRefIndex) VersionRef(version string) (string, error) {
 
 	ref := h.Refs.ResolveRef(version)
 	if ref == "" {
-		return ref, fmt.Errorf("No ref for version: %s", version)
+		return ref, &NotFoundError{fmt.Errorf("No ref for version: %s", version)}
 	}
 	return ref, nil
 }
@@ -28,6 +28,9 @@ import (
   license: <license url>
   contributors: ["Author Name [<email>] [(url)]>", ...]
   sources: [<source urls>]
+
+  # optional encryption
+  key: <key name>  # encrypt blobs with this key (see keys.<name> config)
 */
 
 // Serializable into YAML
@@ -46,6 +49,9 @@ type datafileContents struct {
 	Authors      []string ",omitempty"
 	Contributors []string ",omitempty"
 	Sources      []string ",omitempty"
+
+	// Name of the key blobs are encrypted with. Not the key itself.
+	Key string ",omitempty"
 }
 
 type Datafile struct {
@@ -0,0 +1,155 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The ignore file lists (gitignore-style) patterns of files that are not
+// part of the dataset (scratch files, notebooks, caches), and are thus
+// never added to the manifest. It lives in the dataset's root directory.
+const IgnoreFileName = ".dataignore"
+
+// Patterns ignored unless negated in the ignore file: hidden files, and
+// installed datasets.
+var defaultIgnorePatterns = []string{".*", "/" + DatasetDir + "/"}
+
+type ignoreRule struct {
+	pattern  []string // path segments. "**" matches any number of them.
+	negate   bool     // !pattern: re-includes matching files.
+	dirOnly  bool     // pattern/: matches only directories.
+	anchored bool     // matches from the root (not any basename).
+}
+
+// Ignore matches paths against ignore file patterns. As in gitignore,
+// the last matching pattern decides, and files in ignored directories
+// are ignored (they cannot be re-included).
+type Ignore struct {
+	rules []ignoreRule
+}
+
+func NewIgnore(patterns []string) *Ignore {
+	ig := &Ignore{}
+	for _, p := range patterns {
+		ig.Add(p)
+	}
+	return ig
+}
+
+// Returns the ignore rules of the dataset in dir: the defaults, then those
+// in its ignore file (if any).
+func NewDirIgnore(dir string) (*Ignore, error) {
+	ig := NewIgnore(defaultIgnorePatterns)
+
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ig, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ig.Add(scanner.Text())
+	}
+	return ig, scanner.Err()
+}
+
+// Adds a pattern (one line of an ignore file). Blank lines and #comments
+// are skipped. A leading \ escapes # or !.
+func (ig *Ignore) Add(line string) {
+	p := strings.TrimRight(line, " \t\r")
+	if len(p) == 0 || strings.HasPrefix(p, "#") {
+		return
+	}
+
+	r := ignoreRule{}
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, "\\") {
+		p = p[1:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+
+	// patterns with a (non-trailing) slash are relative to the root.
+	if strings.Contains(p, "/") {
+		r.anchored = true
+		p = strings.TrimLeft(p, "/")
+	}
+
+	if len(p) == 0 {
+		return
+	}
+
+	r.pattern = strings.Split(p, "/")
+	ig.rules = append(ig.rules, r)
+}
+
+// Returns whether path (relative to the root, dir if a directory) is
+// ignored. Does not check path's parent directories.
+func (ig *Ignore) Ignored(path string, dir bool) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if path == "." {
+		return false
+	}
+
+	segs := strings.Split(path, "/")
+	ignored := false
+	for _, r := range ig.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+
+		var match bool
+		if r.anchored {
+			match = matchSegments(r.pattern, segs)
+		} else {
+			match = matchSegments(r.pattern, segs[len(segs)-1:])
+		}
+
+		if match {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// Matches path segments against pattern segments (globs, or "**").
+func matchSegments(pattern []string, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+
+	if pattern[0] == "**" {
+		for n := 0; n <= len(segs); n++ {
+			if matchSegments(pattern[1:], segs[n:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segs) == 0 {
+		return false
+	}
+
+	match, err := filepath.Match(pattern[0], segs[0])
+	if err != nil || !match {
+		return false
+	}
+	return matchSegments(pattern[1:], segs[1:])
+}
@@ -0,0 +1,119 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		dir      bool
+		ignored  bool
+	}{
+		// basenames match at any depth.
+		{[]string{"*.ipynb"}, "a.ipynb", false, true},
+		{[]string{"*.ipynb"}, "x/y/a.ipynb", false, true},
+		{[]string{"*.ipynb"}, "a.csv", false, false},
+
+		// the last matching pattern decides.
+		{[]string{"*.ipynb", "!keep.ipynb"}, "keep.ipynb", false, false},
+		{[]string{"*.ipynb", "!keep.ipynb"}, "x/keep.ipynb", false, false},
+		{[]string{"*.ipynb", "!keep.ipynb"}, "drop.ipynb", false, true},
+		{[]string{"!keep.ipynb", "*.ipynb"}, "keep.ipynb", false, true},
+
+		// leading slash: anchored at the root. trailing slash: dirs only.
+		{[]string{"/build/"}, "build", true, true},
+		{[]string{"/build/"}, "build", false, false},
+		{[]string{"/build/"}, "sub/build", true, false},
+		{[]string{"build/"}, "sub/build", true, true},
+
+		// inner slash: anchored too.
+		{[]string{"a/b"}, "a/b", false, true},
+		{[]string{"a/b"}, "x/a/b", false, false},
+
+		// ** matches any number of dirs, including none.
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**/b"}, "x/a/b", false, false},
+		{[]string{"a/**/b"}, "a/x/c", false, false},
+		{[]string{"**/cache"}, "x/y/cache", true, true},
+
+		// comments, blanks, and escapes.
+		{[]string{"# a.csv", "", "  "}, "# a.csv", false, false},
+		{[]string{"\\#a.csv"}, "#a.csv", false, true},
+		{[]string{"\\!a.csv"}, "!a.csv", false, true},
+
+		// defaults: hidden files, and installed datasets.
+		{defaultIgnorePatterns, ".DS_Store", false, true},
+		{defaultIgnorePatterns, "x/.git", true, true},
+		{defaultIgnorePatterns, DatasetDir, true, true},
+		{defaultIgnorePatterns, "x/" + DatasetDir, true, false},
+		{defaultIgnorePatterns, "a.csv", false, false},
+		{[]string{".*", "!.keep"}, ".keep", false, false},
+	}
+
+	for _, test := range tests {
+		ignored := NewIgnore(test.patterns).Ignored(test.path, test.dir)
+		if ignored != test.ignored {
+			t.Errorf("%q, %s (dir: %v): ignored %v, expected %v",
+				test.patterns, test.path, test.dir, ignored, test.ignored)
+		}
+	}
+}
+
+// Files in ignored dirs stay ignored, even if negated.
+func TestIgnoredDirNegation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "data-ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{"a.csv", "build/out.csv", "build/keep.csv", "x/keep.csv"}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignore := []byte("build/\n!keep.csv\n!build/keep.csv\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, IgnoreFileName), ignore, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := listAllFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, path := range listed {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	sort.Strings(got)
+
+	expected := []string{"a.csv", "x/keep.csv"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("listed %q, expected %q", got, expected)
+	}
+}
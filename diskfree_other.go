@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Free space is unknown here (no statfs, or a different one): callers skip
+// their checks.
+func diskFree(path string) (int64, error) {
+	return 0, fmt.Errorf("free space unknown on %s", runtime.GOOS)
+}
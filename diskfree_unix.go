@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"syscall"
+)
+
+// Returns the bytes available (to unprivileged users) on the filesystem
+// of path.
+func diskFree(path string) (int64, error) {
+	st := syscall.Statfs_t{}
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,256 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore is a blobStore backed by a local (or network mounted)
+// directory. Blobs are fanned out into subdirectories by the first
+// two characters of their name, as git does:
+//
+//	<root>/blob/ab/cdef0123...
+//
+// Compressed blobs carry their codec as a file suffix (cdef0123...gz).
+type FileStore struct {
+	root string
+}
+
+func init() {
+	registerBlobStore("file", newFileStoreFromUrl)
+}
+
+// file:///<path>
+func newFileStoreFromUrl(u *url.URL, index *DataIndex) (blobStore, error) {
+	s, err := NewFileStore(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewFileStore(root string) (*FileStore, error) {
+	if len(root) < 1 {
+		return nil, fmt.Errorf("Invalid (empty) FileStore directory.")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{root: root}, nil
+}
+
+// Returns the filesystem path for key.
+func (s *FileStore) Path(key string) string {
+	dir, name := filepath.Split(filepath.FromSlash(key))
+	if len(name) > 2 {
+		dir = filepath.Join(dir, name[:2])
+		name = name[2:]
+	}
+	return filepath.Join(s.root, dir, name)
+}
+
+func (s *FileStore) Url(key string) string {
+	u := &url.URL{Scheme: "file", Path: filepath.ToSlash(s.Path(key))}
+	return u.String()
+}
+
+// map { codec : file suffix }, in lookup order.
+var fileCodecs = []string{CodecNone, CodecGzip, CodecZstd}
+var fileCodecSuffixes = map[string]string{
+	CodecNone: "",
+	CodecGzip: ".gz",
+	CodecZstd: ".zst",
+}
+
+// Has any encoding of the blob.
+func (s *FileStore) Has(key string) (bool, error) {
+	_, exists, err := s.Stat(key)
+	return exists, err
+}
+
+// Returns the stored size of any encoding of the blob.
+func (s *FileStore) Stat(key string) (int64, bool, error) {
+	for _, codec := range fileCodecs {
+		fi, err := os.Stat(s.Path(key) + fileCodecSuffixes[codec])
+		if err == nil {
+			return fi.Size(), true, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return 0, false, err
+		}
+	}
+
+	return 0, false, nil
+}
+
+func (s *FileStore) Put(key string, value io.Reader) error {
+	return s.PutEncoded(key, value, CodecNone)
+}
+
+// Puts value, encoded with codec. Other encodings of it are removed.
+func (s *FileStore) PutEncoded(key string, value io.Reader, codec string) error {
+	suffix, ok := fileCodecSuffixes[codec]
+	if !ok {
+		return checkCodec(codec)
+	}
+
+	p := s.Path(key)
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), ".put-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed.
+
+	_, err = io.Copy(f, value)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// blobs are immutable, but should be readable by others sharing the store.
+	err = os.Chmod(tmp, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, p+suffix)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range fileCodecs {
+		if other != codec {
+			os.Remove(p + fileCodecSuffixes[other])
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.Path(key))
+}
+
+func (s *FileStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.Path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{io.LimitReader(f, length), f}, nil
+}
+
+// Raw blobs are stored at their path, encoded ones with their codec's
+// suffix (see fileCodecSuffixes).
+func (s *FileStore) GetEncoded(key string, offset int64) (io.ReadCloser, string, error) {
+	r, err := s.GetRange(key, offset, -1)
+	if err == nil || !os.IsNotExist(err) {
+		return r, CodecNone, err
+	}
+
+	for _, codec := range fileCodecs[1:] {
+		f, ferr := os.Open(s.Path(key) + fileCodecSuffixes[codec])
+		if ferr == nil {
+			return f, codec, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+func (s *FileStore) List(prefix string, fn func(key string, size int64, modified time.Time) error) error {
+	err := filepath.Walk(s.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return err // skips temporary (.put-*) files
+		}
+
+		// skip unfinished downloads (e.g. into the cache)
+		if strings.HasSuffix(fi.Name(), PartialSuffix) {
+			return nil
+		}
+
+		key, err := s.pathKey(p)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			return err
+		}
+		return fn(key, fi.Size(), fi.ModTime())
+	})
+
+	if os.IsNotExist(err) {
+		return nil // empty store.
+	}
+	return err
+}
+
+// Returns the key stored at path p (the inverse of Path).
+func (s *FileStore) pathKey(p string) (string, error) {
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, codec := range fileCodecs[1:] {
+		rel = strings.TrimSuffix(rel, fileCodecSuffixes[codec])
+	}
+
+	dir, name := filepath.Split(rel)
+	dir, fan := filepath.Split(filepath.Clean(dir))
+	return "/" + filepath.ToSlash(filepath.Join(dir, fan+name)), nil
+}
+
+// Deletes all encodings of the blob.
+func (s *FileStore) Delete(key string) error {
+	for _, codec := range fileCodecs {
+		err := os.Remove(s.Path(key) + fileCodecSuffixes[codec])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads from the limited reader, closes the underlying file.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,239 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HttpStore is a blobStore on any http server supporting HEAD, GET and
+// PUT (e.g. nginx with WebDAV, or an S3-compatible gateway). Requests
+// carry the index user credentials, as the index HttpClient's do.
+type HttpStore struct {
+	Http *HttpClient
+}
+
+func init() {
+	registerBlobStore("http", newHttpStoreFromUrl)
+	registerBlobStore("https", newHttpStoreFromUrl)
+}
+
+// http[s]://<host>/<path>
+func newHttpStoreFromUrl(u *url.URL, index *DataIndex) (blobStore, error) {
+	s, err := NewHttpStore(u.String(), index)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewHttpStore(baseUrl string, index *DataIndex) (*HttpStore, error) {
+	if !isUrl(baseUrl) {
+		return nil, fmt.Errorf("Invalid HttpStore url: %s", baseUrl)
+	}
+
+	baseUrl = strings.TrimSuffix(baseUrl, "/")
+	h := &HttpClient{BaseUrl: baseUrl, Url: baseUrl}
+
+	// use the index's credentials, if any.
+	if index != nil && index.Http != nil {
+		h.User = index.Http.User
+		h.AuthToken = index.Http.AuthToken
+	}
+
+	return &HttpStore{Http: h}, nil
+}
+
+func (s *HttpStore) Url(key string) string {
+	return s.Http.SubUrl(strings.TrimPrefix(key, "/"))
+}
+
+func (s *HttpStore) Has(key string) (bool, error) {
+	_, exists, err := s.Stat(key)
+	return exists, err
+}
+
+func (s *HttpStore) Stat(key string) (int64, bool, error) {
+	resp, err := s.do("HEAD", key, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	c := resp.StatusCode
+	switch {
+	case 200 <= c && c < 300:
+		return resp.ContentLength, true, nil
+	case c == http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, httpStatusError(resp)
+	}
+}
+
+func (s *HttpStore) Put(key string, value io.Reader) error {
+	return s.PutEncoded(key, value, CodecNone)
+}
+
+// Puts value, encoded with codec. The server must keep the codec header
+// (as S3-compatible servers keep user metadata).
+func (s *HttpStore) PutEncoded(key string, value io.Reader, codec string) error {
+	req, err := s.newRequest("PUT", key, value)
+	if err != nil {
+		return err
+	}
+
+	if codec != CodecNone {
+		req.Header.Set(CodecHeader, codec)
+	}
+
+	resp, err := s.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c := resp.StatusCode
+	if 200 <= c && c < 300 {
+		return nil
+	}
+	return httpStatusError(resp)
+}
+
+func (s *HttpStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := resp.StatusCode
+	if 200 <= c && c < 300 {
+		return resp.Body, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, httpStatusError(resp)
+}
+
+func (s *HttpStore) GetEncoded(key string, offset int64) (io.ReadCloser, string, error) {
+	return getEncodedResponse(func(offset int64) (*http.Response, error) {
+		req, err := s.newRequest("GET", key, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if offset > 0 {
+			req.Header.Set("Range", httpRange(offset, -1))
+		}
+
+		resp, err := s.doRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		c := resp.StatusCode
+		if 200 <= c && c < 300 {
+			return resp, nil
+		}
+
+		defer resp.Body.Close()
+		return nil, httpStatusError(resp)
+	}, offset)
+}
+
+func (s *HttpStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", httpRange(offset, length))
+
+	resp, err := s.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	c := resp.StatusCode
+	if 200 <= c && c < 300 {
+		r, err := rangeResponseBody(resp, offset)
+		if err != nil || length < 0 || c == http.StatusPartialContent {
+			return r, err
+		}
+		return &limitedReadCloser{io.LimitReader(r, length), r}, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, httpStatusError(resp)
+}
+
+func (s *HttpStore) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c := resp.StatusCode
+	if (200 <= c && c < 300) || c == http.StatusNotFound {
+		return nil
+	}
+	return httpStatusError(resp)
+}
+
+func (s *HttpStore) do(method string, key string, body io.Reader) (*http.Response, error) {
+	req, err := s.newRequest(method, key, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.doRequest(req)
+}
+
+// Files (e.g. *os.File) can tell their size, and be resent.
+type fileReader interface {
+	io.ReadSeeker
+	Stat() (os.FileInfo, error)
+}
+
+func (s *HttpStore) newRequest(method string, key string, body io.Reader) (*http.Request, error) {
+	f, isFile := body.(fileReader)
+	if isFile {
+		body = ioutil.NopCloser(f) // keep it open, to resend when retrying.
+	}
+
+	req, err := http.NewRequest(method, s.Url(key), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// some servers refuse chunked uploads. send length when known.
+	if isFile {
+		if fi, err := f.Stat(); err == nil {
+			req.ContentLength = fi.Size()
+		}
+
+		if start, err := f.Seek(0, os.SEEK_CUR); err == nil {
+			req.ContentLength -= start
+			req.GetBody = func() (io.ReadCloser, error) {
+				_, err := f.Seek(start, os.SEEK_SET)
+				return ioutil.NopCloser(f), err
+			}
+		}
+	}
+
+	s.Http.AddAuthHeaders(req)
+	return req, nil
+}
+
+func (s *HttpStore) doRequest(req *http.Request) (*http.Response, error) {
+	dOut("http blobstore %s %s\n", strings.ToLower(req.Method), req.URL)
+	return doHttpRequest(nil, req)
+}
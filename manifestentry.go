@@ -0,0 +1,165 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"launchpad.net/goyaml"
+)
+
+// Manifest format versions. Version 1 (legacy) is the flat mapping
+// { <path>: <hash> }. Version 2 adds file metadata (see ManifestEntry):
+//
+//	version: 2
+//	files:
+//	  <path>: { hash: <hash>, size: <bytes>, mode: "0644", type: text/csv }
+//
+// Manifests are written in the version they were read in (their hash is
+// their blob name), and upgraded once their files change.
+const (
+	ManifestVersionLegacy = 1
+	ManifestVersion       = 2 // current
+)
+
+// serializable into YAML
+type ManifestEntry struct {
+	Hash string
+	Size int64  ",omitempty" // bytes
+	Mode string ",omitempty" // permissions, in octal. e.g. 0755
+	Type string ",omitempty" // media type, if known. e.g. text/csv
+}
+
+// serializable into YAML
+type manifestV2 struct {
+	Version int
+	Files   map[string]ManifestEntry
+}
+
+// Returns the entry of the file at path (stat-ed by fi) hashing to hash.
+func newManifestEntry(path string, hash string, fi os.FileInfo) ManifestEntry {
+	return ManifestEntry{
+		Hash: hash,
+		Size: fi.Size(),
+		Mode: fmt.Sprintf("%04o", fi.Mode().Perm()),
+		Type: mediaTypes[strings.ToLower(filepath.Ext(path))],
+	}
+}
+
+// Returns the entry's permissions (0 if unknown).
+func (e ManifestEntry) FileMode() os.FileMode {
+	mode, err := strconv.ParseUint(e.Mode, 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(mode) & os.ModePerm
+}
+
+// Media types of common data file extensions. (Not the system's tables:
+// manifests must serialize the same everywhere.)
+var mediaTypes = map[string]string{
+	".csv":  "text/csv",
+	".tsv":  "text/tab-separated-values",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+	".html": "text/html",
+	".xml":  "application/xml",
+	".json": "application/json",
+	".yaml": "application/x-yaml",
+	".yml":  "application/x-yaml",
+	".pdf":  "application/pdf",
+	".zip":  "application/zip",
+	".gz":   "application/gzip",
+	".tar":  "application/x-tar",
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".svg":  "image/svg+xml",
+}
+
+// Manifest serialized form: legacy or version 2. (see SerializedFile)
+func (mf *Manifest) serialForm() interface{} {
+	if mf.Version < ManifestVersion {
+		return mf.Files
+	}
+
+	files := map[string]ManifestEntry{}
+	for path, hash := range mf.Files {
+		e := mf.entries[path]
+		e.Hash = hash
+		files[path] = e
+	}
+	return &manifestV2{Version: mf.Version, Files: files}
+}
+
+func (mf *Manifest) readSerialForm(buf []byte) error {
+	// versioned manifests have a numeric version. (legacy manifests map
+	// paths to hashes, so a file named "version" maps to a string.)
+	probe := map[string]interface{}{}
+	err := goyaml.Unmarshal(buf, &probe)
+	if err != nil {
+		return err
+	}
+
+	if _, versioned := probe["version"].(int); !versioned {
+		mf.Version = ManifestVersionLegacy
+		err := goyaml.Unmarshal(buf, mf.Files)
+		mf.legacy = blobPaths{}
+		for path, hash := range mf.Files {
+			mf.legacy[path] = hash
+		}
+		return err
+	}
+
+	v := manifestV2{}
+	err = goyaml.Unmarshal(buf, &v)
+	if err != nil {
+		return err
+	}
+
+	if v.Version > ManifestVersion {
+		return fmt.Errorf("data manifest: unsupported version %d (try upgrading data)",
+			v.Version)
+	}
+
+	// entries of upgraded legacy files (and unhashed files) have no
+	// metadata: only a hash.
+	mf.Version = v.Version
+	for path, e := range v.Files {
+		mf.Files[path] = e.Hash
+		if e.Hash != noHash && len(e.Mode) > 0 {
+			mf.entries[path] = e
+		}
+	}
+	return nil
+}
+
+// Returns the entry of the file at path, and whether it has metadata
+// (legacy manifests, and unhashed files, have none).
+func (mf *Manifest) Entry(path string) (ManifestEntry, bool) {
+	e, found := mf.entries[path]
+	e.Hash = mf.Files[path]
+	return e, found
+}
+
+// Returns the size of the files in the manifest, and whether it is known
+// (all files have metadata).
+func (mf *Manifest) Size() (int64, bool) {
+	size := int64(0)
+	for path := range mf.Files {
+		e, found := mf.Entry(path)
+		if !found {
+			return 0, false
+		}
+		size += e.Size
+	}
+	return size, true
+}
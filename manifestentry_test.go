@@ -0,0 +1,127 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	testSha1   = strings.Repeat("a1", 20)
+	testSha256 = strings.Repeat("b2", 32)
+)
+
+func readManifest(t *testing.T, buf []byte) *Manifest {
+	mf := NewManifest("")
+	if err := mf.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	return mf
+}
+
+func TestManifestLegacy(t *testing.T) {
+	// a file named "version" must not make it look versioned.
+	legacy := "a.csv: " + testSha1 + "\nversion: " + testSha1 + "\n"
+	mf := readManifest(t, []byte(legacy))
+	if mf.Version != ManifestVersionLegacy {
+		t.Fatalf("read as version %d", mf.Version)
+	}
+
+	expected := blobPaths{"a.csv": testSha1, "version": testSha1}
+	if !reflect.DeepEqual(mf.Files, expected) {
+		t.Fatalf("files %v, expected %v", mf.Files, expected)
+	}
+	if _, found := mf.Entry("a.csv"); found {
+		t.Fatal("legacy entry has metadata")
+	}
+
+	// unchanged: written as read, so its hash stays the same.
+	mf.upgrade()
+	buf, err := mf.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != legacy {
+		t.Fatalf("unchanged legacy manifest rewritten: %q", buf)
+	}
+
+	// changed: upgraded, keeping the legacy hashes.
+	mf.Files["b.csv"] = testSha256
+	mf.upgrade()
+	if mf.Version != ManifestVersion {
+		t.Fatalf("changed legacy manifest not upgraded: version %d", mf.Version)
+	}
+
+	buf, err = mf.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(buf), "version: 2\n") {
+		t.Fatalf("upgraded manifest: %q", buf)
+	}
+
+	upgraded := readManifest(t, buf)
+	expected["b.csv"] = testSha256
+	if upgraded.Version != ManifestVersion || !reflect.DeepEqual(upgraded.Files, expected) {
+		t.Fatalf("upgraded: version %d, files %v", upgraded.Version, upgraded.Files)
+	}
+	if _, known := upgraded.Size(); known {
+		t.Fatal("upgraded legacy files have metadata")
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	mf := NewManifest("")
+	mf.Files = blobPaths{
+		"a.csv":     testSha256,
+		"bin/run":   testSha1,
+		"unhashed":  noHash,
+		"no/meta.x": testSha256,
+	}
+	mf.entries = map[string]ManifestEntry{
+		"a.csv":   {Hash: testSha256, Size: 3, Mode: "0644", Type: "text/csv"},
+		"bin/run": {Hash: testSha1, Size: 1 << 40, Mode: "0755"},
+	}
+
+	buf, err := mf.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := readManifest(t, buf)
+	if read.Version != ManifestVersion {
+		t.Fatalf("read as version %d", read.Version)
+	}
+	if !reflect.DeepEqual(read.Files, mf.Files) {
+		t.Fatalf("files %v, expected %v", read.Files, mf.Files)
+	}
+	for path := range mf.Files {
+		e, found := read.Entry(path)
+		expected, expectedFound := mf.Entry(path)
+		if found != expectedFound || e != expected {
+			t.Errorf("%s: entry %v (%v), expected %v (%v)",
+				path, e, found, expected, expectedFound)
+		}
+	}
+
+	buf2, err := read.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf2) != string(buf) {
+		t.Fatalf("serialized differently:\n%s\n%s", buf, buf2)
+	}
+}
+
+func TestManifestFutureVersion(t *testing.T) {
+	mf := NewManifest("")
+	buf := []byte("version: 3\nfiles:\n  a.csv: { hash: " + testSha256 + " }\n")
+	if err := mf.Unmarshal(buf); err == nil {
+		t.Fatal("read a manifest of a future version")
+	}
+}
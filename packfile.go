@@ -0,0 +1,371 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Small blobs can be bundled into packfiles (as in git), to upload and
+// store many tiny files as few objects. Packfiles are the concatenated
+// contents of their blobs, named by their own hash. The pack index
+// records where each packed blob is. It is tracked in the Manifest
+// (like any file), so downloaders find it before the blobs it indexes.
+const PacksFileName = ".data/Packs"
+
+// Blobs smaller than PackBlobMaxSize are packed, into packfiles up to
+// PackMaxSize (below ChunkThreshold, so packs are never chunked).
+const PackBlobMaxSize = 256 << 10 // 256KiB
+const PackMaxSize = 8 << 20       // 8MiB
+
+type PackedBlob struct {
+	Hash   string
+	Offset int64
+	Size   int64
+
+	// Packs are stored as they are (not through codecs, or encryption).
+	// Their blobs are encoded one by one instead, so each can be read on
+	// its own. (Packs from before are encoded whole: Stored is 0.)
+	Stored int64  ",omitempty" // bytes in the pack
+	Codec  string ",omitempty" // compression codec
+	Sealed bool   ",omitempty" // encrypted. see sealBlob.
+}
+
+type Packfile struct {
+	Hash  string
+	Blobs []PackedBlob
+}
+
+type PackIndex struct {
+	SerializedFile "-"
+	Packs          []Packfile ""
+
+	// map { blob hash : location }
+	blobs map[string]packedLocation
+}
+
+type packedLocation struct {
+	pack string
+	blob PackedBlob
+}
+
+func NewPackIndex(path string) *PackIndex {
+	pi := &PackIndex{SerializedFile: SerializedFile{Path: path}}
+	pi.SerializedFile.Format = &pi.Packs
+
+	// attempt to load
+	if len(path) > 0 {
+		pi.ReadFile()
+	}
+
+	pi.reindex()
+	return pi
+}
+
+func NewDefaultPackIndex() *PackIndex {
+	return NewPackIndex(PacksFileName)
+}
+
+func (pi *PackIndex) reindex() {
+	pi.blobs = map[string]packedLocation{}
+	for _, p := range pi.Packs {
+		for _, b := range p.Blobs {
+			pi.blobs[b.Hash] = packedLocation{p.Hash, b}
+		}
+	}
+}
+
+// Returns the packfile (hash) blob is in, and where.
+func (pi *PackIndex) Find(hash string) (string, PackedBlob, bool) {
+	l, found := pi.blobs[hash]
+	return l.pack, l.blob, found
+}
+
+func (pi *PackIndex) Add(p Packfile) {
+	pi.Packs = append(pi.Packs, p)
+	for _, b := range p.Blobs {
+		pi.blobs[b.Hash] = packedLocation{p.Hash, b}
+	}
+}
+
+// Drops packfiles holding none of the live blobs. (Packs holding some
+// stay whole, as they are stored whole.)
+func (pi *PackIndex) Prune(live map[string]bool) {
+	packs := []Packfile{}
+	for _, p := range pi.Packs {
+		for _, b := range p.Blobs {
+			if live[b.Hash] {
+				packs = append(packs, p)
+				break
+			}
+		}
+	}
+
+	pi.Packs = packs
+	pi.reindex()
+}
+
+// Returns the blobstore key for packfile
+func PackKey(hash string) string {
+	return hashKey("pack", hash)
+}
+
+// DataIndex extension to get the pack index of the dataset in the working
+// directory. Loaded once; see reloadPackIndex.
+func (i *DataIndex) packIndex() *PackIndex {
+	i.packsLk.Lock()
+	defer i.packsLk.Unlock()
+
+	if i.packs == nil {
+		i.packs = NewDefaultPackIndex()
+	}
+	return i.packs
+}
+
+func (i *DataIndex) reloadPackIndex() {
+	i.packsLk.Lock()
+	defer i.packsLk.Unlock()
+	i.packs = nil
+}
+
+// Opens packed blob for reading from offset, with a range read of its
+// packfile. Returns nil if blob is not packed.
+func (i *DataIndex) findPackedBlob(hash string, offset int64) (io.ReadCloser, error) {
+	return i.findPackedBlobIn(i.packIndex(), hash, offset)
+}
+
+// Like findPackedBlob, with pack index pi (e.g. of another dataset).
+func (i *DataIndex) findPackedBlobIn(pi *PackIndex, hash string, offset int64) (io.ReadCloser, error) {
+	pack, b, found := pi.Find(hash)
+	if !found {
+		return nil, nil
+	}
+
+	dOut("found packed blob (pack %s). \n", shortHash(pack))
+	if offset >= b.Size {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	if b.Stored == 0 {
+		return getBlobRange(i.BlobStore, PackKey(pack), b.Offset+offset, b.Size-offset)
+	}
+
+	r, err := getBlobRange(i.storedBlobStore(), PackKey(pack), b.Offset, b.Stored)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return nil, netError(err)
+	}
+
+	r, err = decodePacked(b, stored)
+	if err != nil || offset == 0 {
+		return r, err
+	}
+	return skipReader(r, offset)
+}
+
+// Returns the index's blobstore, as stored (not through codecs, etc).
+func (i *DataIndex) storedBlobStore() blobStore {
+	if i.rawStore != nil {
+		return i.rawStore
+	}
+	return i.BlobStore
+}
+
+// Encodes the contents of blob hash to pack them, as blobs are stored:
+// compressed with the index's codec (if smaller), then encrypted with its
+// key (if any). See codecStore, cryptStore.
+func (i *DataIndex) encodePacked(hash string, raw []byte) ([]byte, PackedBlob, error) {
+	b := PackedBlob{Hash: hash, Size: int64(len(raw)), Codec: CodecNone}
+	out := raw
+
+	if len(i.codec) > 0 && i.codec != CodecNone {
+		var buf bytes.Buffer
+		err := encode(&buf, bytes.NewReader(raw), i.codec)
+		if err != nil {
+			return nil, b, err
+		}
+
+		if buf.Len() < len(raw) {
+			out = buf.Bytes()
+			b.Codec = i.codec
+		}
+	}
+
+	if len(i.key) > 0 {
+		sealed, err := sealBlob(i.key, BlobKey(hash), out)
+		if err != nil {
+			return nil, b, err
+		}
+		out = sealed
+		b.Sealed = true
+	}
+
+	b.Stored = int64(len(out))
+	return out, b, nil
+}
+
+// Decodes the stored bytes of packed blob b. See encodePacked.
+func decodePacked(b PackedBlob, stored []byte) (io.ReadCloser, error) {
+	if b.Sealed {
+		plain, err := openBlob(BlobKey(b.Hash), stored)
+		if err != nil {
+			return nil, err
+		}
+		stored = plain
+	}
+
+	return decode(ioutil.NopCloser(bytes.NewReader(stored)), b.Codec)
+}
+
+// DataIndex extension to bundle small blobs missing from the blobstore
+// into packfiles, and upload them. Packed blobs are added to pi.
+func (i *DataIndex) putPackedBlobs(blobs blobPaths, pi *PackIndex) error {
+
+	// flip map, to skip dupes. sort by path, to pack neighbors together.
+	paths := []string{}
+	seen := map[string]bool{}
+	for path, hash := range blobs {
+		if !seen[hash] {
+			paths = append(paths, path)
+			seen[hash] = true
+		}
+	}
+	sort.Strings(paths)
+
+	var lk sync.Mutex
+	small := []string{}
+	errs := parallel(len(paths), i.Jobs, func(n int) error {
+		fi, err := os.Stat(paths[n])
+		if err != nil || fi.Size() >= PackBlobMaxSize {
+			return err
+		}
+
+		exists, err := i.hasBlob(blobs[paths[n]])
+		if err != nil || exists {
+			return err
+		}
+
+		lk.Lock()
+		small = append(small, paths[n])
+		lk.Unlock()
+		return nil
+	})
+	if err := newTransferErrors("has blob", len(paths), errs); err != nil {
+		return err
+	}
+	sort.Strings(small)
+
+	// group into packs.
+	groups := [][]string{}
+	size := int64(0)
+	for _, path := range small {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if len(groups) == 0 || size+fi.Size() > PackMaxSize {
+			groups = append(groups, []string{})
+			size = 0
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], path)
+		size += fi.Size()
+	}
+
+	// packs are sized once built.
+	prog := startProgress("put pack", len(groups), -1)
+	errs = parallel(len(groups), i.Jobs, func(n int) error {
+		p, err := i.putPackfile(groups[n], blobs)
+		if err != nil {
+			return err
+		}
+
+		lk.Lock()
+		pi.Add(*p)
+		lk.Unlock()
+		return nil
+	})
+	prog.Stop()
+	return newTransferErrors("put pack", len(groups), errs)
+}
+
+// Builds the packfile of the files at paths, and uploads it.
+func (i *DataIndex) putPackfile(paths []string, blobs blobPaths) (*Packfile, error) {
+	var buf bytes.Buffer
+	p := &Packfile{}
+
+	for _, path := range paths {
+		hash := blobs[path]
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// must verify hash before uploading (for integrity).
+		vh, err := readerHashAlgo(bytes.NewReader(contents), hashAlgorithm(hash))
+		if err != nil {
+			return nil, err
+		}
+
+		if vh != hash {
+			m := "put pack: %s hash error (expected %s, got %s)"
+			return nil, fmt.Errorf(m, path, hash, vh)
+		}
+
+		stored, b, err := i.encodePacked(hash, contents)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Offset = int64(buf.Len())
+		p.Blobs = append(p.Blobs, b)
+		buf.Write(stored)
+	}
+
+	var err error
+	p.Hash, err = readerHash(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("put pack %s", shortHash(p.Hash))
+	pErr("%s - uploading %d blobs\n", name, len(p.Blobs))
+	bp := currentProgress().startBlob(name, int64(buf.Len()))
+	defer bp.Done()
+
+	f := &bytesFile{bytes.NewReader(buf.Bytes()), PackKey(p.Hash)}
+	err = i.storedBlobStore().Put(PackKey(p.Hash), throttleFile(bp.file(f)))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// bytesFile is a fileReader of contents in memory (e.g. a packfile), to
+// upload them as files are: sized, resent when retrying, and throttled.
+type bytesFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *bytesFile) Stat() (os.FileInfo, error) { return f, nil }
+func (f *bytesFile) Name() string               { return f.name }
+func (f *bytesFile) Mode() os.FileMode          { return 0444 }
+func (f *bytesFile) ModTime() time.Time         { return time.Time{} }
+func (f *bytesFile) IsDir() bool                { return false }
+func (f *bytesFile) Sys() interface{}           { return nil }
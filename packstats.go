@@ -0,0 +1,211 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+
+	"github.com/gonuts/flag"
+	"github.com/jbenet/commander"
+)
+
+var cmd_data_pack_stats = &commander.Command{
+	UsageLine: "stats [--yaml] [<dataset>]",
+	Short:     "Show package storage statistics.",
+	Long: `data pack stats - Show package storage statistics.
+
+    Shows how much blobstore storage the published versions of <dataset>
+    (default: the package in the working directory) take up, how much
+    of it each version shares with others (i.e. is deduplicated), and
+    which objects (blobs, chunks, packfiles) are missing.
+
+    Sizes are of stored objects (compressed, or encrypted), asked of the
+    blobstore (HEAD, or stat). --yaml outputs yaml, for scripts.
+
+    See 'data pack', and 'data blob stat'.
+
+Arguments:
+
+    <dataset>   dataset (<author>/<name>) to show statistics of.
+
+  `,
+	Run:  packStatsCmd,
+	Flag: *flag.NewFlagSet("data-pack-stats", flag.ExitOnError),
+}
+
+func init() {
+	cmd_data_pack_stats.Flag.Bool("yaml", false, "output yaml")
+	cmd_data_pack_stats.Flag.Int("jobs", 0, jobsFlagUsage)
+}
+
+// serializable into YAML
+type PackStats struct {
+	Dataset  string
+	Versions []VersionStats
+
+	Objects    int      // distinct objects, in all versions
+	Referenced int64    // bytes, summed over versions
+	Stored     int64    // bytes, of distinct objects
+	Missing    []string ",omitempty"
+}
+
+// serializable into YAML
+type VersionStats struct {
+	Ref       string
+	Version   string ",omitempty"
+	Published string
+	Files     int
+	Objects   int
+	Stored    int64 // bytes
+	Unique    int64 // bytes in objects no other version references
+	Shared    int64 // bytes in objects other versions reference too
+	Missing   int   // objects
+}
+
+func packStatsCmd(c *commander.Command, args []string) error {
+	dataset := ""
+	if len(args) > 0 {
+		dataset = NewHandle(args[0]).Path()
+	} else {
+		df, err := NewDefaultDatafile()
+		if err != nil {
+			return fmt.Errorf("%v: requires <dataset> argument (or a Datafile)", c.FullName())
+		}
+		dataset = df.Handle().Path()
+	}
+
+	di, err := NewMainDataIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := transferFlags(c); err != nil {
+		return err
+	}
+
+	// sizes as stored (not through codecs, etc).
+	store, err := newBlobStore(configBlobStore(di.Name), di)
+	if err != nil {
+		return err
+	}
+
+	stats, err := di.packStats(store, dataset)
+	if err != nil {
+		return err
+	}
+
+	if c.Flag.Lookup("yaml").Value.Get().(bool) {
+		buf, err := Marshal(stats)
+		if err != nil {
+			return err
+		}
+		pOut("%s", buf)
+		return nil
+	}
+
+	pOut("%s - %d published versions\n\n", stats.Dataset, len(stats.Versions))
+	pOut("%-10s %-7s %6s %8s %10s %10s %10s %8s\n", "version", "ref",
+		"files", "objects", "stored", "unique", "shared", "missing")
+	for _, v := range stats.Versions {
+		pOut("%-10s %-7s %6d %8d %10s %10s %10s %8d\n", v.Version,
+			shortHash(v.Ref), v.Files, v.Objects, humanBytes(v.Stored),
+			humanBytes(v.Unique), humanBytes(v.Shared), v.Missing)
+	}
+
+	saved := 0
+	if stats.Referenced > 0 {
+		saved = int((stats.Referenced - stats.Stored) * 100 / stats.Referenced)
+	}
+	pOut("\n%d objects, %s stored (%s referenced, %d%% saved by deduplication).\n",
+		stats.Objects, humanBytes(stats.Stored), humanBytes(stats.Referenced), saved)
+
+	if len(stats.Missing) > 0 {
+		pOut("%d objects missing:\n", len(stats.Missing))
+		for _, key := range stats.Missing {
+			pOut("  %s\n", key)
+		}
+	}
+	return nil
+}
+
+// DataIndex extension to gather the storage statistics of the published
+// versions of dataset, in store (the index's blobstore, as stored).
+func (i *DataIndex) packStats(store blobStore, dataset string) (*PackStats, error) {
+	ri := i.RefIndex(dataset)
+	err := ri.FetchRefs(false)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding refs for %v. %s", dataset, err)
+	}
+
+	stats := &PackStats{Dataset: dataset}
+	versionKeys := [][]string{}
+	users := map[string]int{} // { key : versions referencing it }
+	keys := []string{}
+
+	for _, ref := range ri.SortedPublished() {
+		mf := NewManifest("")
+		err := mf.ReadBlobFrom(i, ref)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading manifest %s of %v. %s",
+				shortHash(ref), dataset, err)
+		}
+
+		objs, err := i.manifestObjects(mf, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		vkeys := set(append(objs.Data, objs.Indexes...))
+		for _, key := range vkeys {
+			if users[key] == 0 {
+				keys = append(keys, key)
+			}
+			users[key]++
+		}
+		versionKeys = append(versionKeys, vkeys)
+
+		v := VersionStats{Ref: ref, Files: len(mf.Files), Objects: len(vkeys)}
+		v.Published, _ = ri.RefTimestamp(ref)
+		if ver := ri.Refs.ResolveVersion(ref); ver != ref {
+			v.Version = ver
+		}
+		stats.Versions = append(stats.Versions, v)
+	}
+
+	sizes, err := statBlobs(store, keys, i.Jobs)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Objects = len(keys)
+	for _, key := range keys {
+		if size, found := sizes[key]; !found {
+			stats.Missing = append(stats.Missing, key)
+		} else if size > 0 {
+			stats.Stored += size
+		}
+	}
+
+	for n := range stats.Versions {
+		v := &stats.Versions[n]
+		for _, key := range versionKeys[n] {
+			size, found := sizes[key]
+			switch {
+			case !found:
+				v.Missing++
+			case size < 0: // unknown
+			case users[key] == 1:
+				v.Unique += size
+			default:
+				v.Shared += size
+			}
+		}
+		v.Stored = v.Unique + v.Shared
+		stats.Referenced += v.Stored
+	}
+
+	return stats, nil
+}
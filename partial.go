@@ -0,0 +1,169 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Suffix of files being downloaded. Partial files are kept when
+// downloads fail, and resumed where they left off on the next try.
+const PartialSuffix = ".partial"
+
+// A download in progress, to <path>.partial. Once complete (and verified),
+// it is renamed to <path>.
+type partialFile struct {
+	path   string
+	file   *os.File
+	hasher hash.Hash // nil if the expected hash is not known
+
+	// bytes already downloaded (by previous attempts)
+	Offset int64
+
+	// version of the contents downloaded so far (e.g. an http ETag), if
+	// known. resuming a different version would mix the two.
+	Validator string
+}
+
+// Opens (or resumes) the download of fpath. If hash is not empty, the
+// contents are hashed as they are written, to verify them on Commit.
+func openPartial(fpath string, hash string) (*partialFile, error) {
+	p := &partialFile{path: fpath}
+
+	if len(hash) > 0 {
+		h, err := newHasher(hashAlgorithm(hash))
+		if err != nil {
+			return nil, err
+		}
+		p.hasher = h
+	}
+
+	err := os.MkdirAll(filepath.Dir(fpath), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	p.file, err = os.OpenFile(p.partialPath(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	// hash what we already have, and continue from there.
+	if p.hasher != nil {
+		p.Offset, err = io.Copy(p.hasher, p.file)
+	} else {
+		p.Offset, err = p.file.Seek(0, os.SEEK_END)
+	}
+	if err != nil {
+		p.file.Close()
+		return nil, err
+	}
+
+	if p.Offset > 0 {
+		dOut("resuming %s at %d bytes\n", p.partialPath(), p.Offset)
+		if v, err := ioutil.ReadFile(p.validatorPath()); err == nil {
+			p.Validator = string(v)
+		}
+	}
+	return p, nil
+}
+
+func (p *partialFile) partialPath() string {
+	return p.path + PartialSuffix
+}
+
+// The validator is kept next to the partial file, hidden (not listed in
+// manifests or stores).
+func (p *partialFile) validatorPath() string {
+	dir, name := filepath.Split(p.path)
+	return filepath.Join(dir, "."+name+PartialSuffix)
+}
+
+// Records the version of the contents being downloaded, to resume only
+// that version later.
+func (p *partialFile) SetValidator(v string) error {
+	p.Validator = v
+	if len(v) == 0 {
+		return p.removeValidator()
+	}
+	return ioutil.WriteFile(p.validatorPath(), []byte(v), 0666)
+}
+
+func (p *partialFile) removeValidator() error {
+	err := os.Remove(p.validatorPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (p *partialFile) Write(buf []byte) (int, error) {
+	n, err := p.file.Write(buf)
+	if p.hasher != nil {
+		p.hasher.Write(buf[:n])
+	}
+	p.Offset += int64(n)
+	return n, err
+}
+
+// Discards the contents downloaded so far, to start over.
+func (p *partialFile) Truncate() error {
+	err := p.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+
+	if p.hasher != nil {
+		p.hasher.Reset()
+	}
+	p.Offset = 0
+	return p.SetValidator("")
+}
+
+// Verifies the contents match hash (if given), and moves them into place.
+// Mismatching contents are discarded, as resuming them is pointless.
+func (p *partialFile) Commit(hash string) error {
+	err := p.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if p.hasher != nil && len(hash) > 0 {
+		got := formatHash(hashAlgorithm(hash), p.hasher.Sum(nil))
+		if got != hash {
+			os.Remove(p.partialPath())
+			p.removeValidator()
+			return &HashMismatchError{Path: p.path, Expected: hash, Got: got}
+		}
+	}
+
+	err = os.Rename(p.partialPath(), p.path)
+	if err != nil {
+		return err
+	}
+	return p.removeValidator()
+}
+
+// Closes the partial file, keeping it to resume later.
+func (p *partialFile) Close() error {
+	return p.file.Close()
+}
+
+// Closes and removes the partial file.
+func (p *partialFile) Discard() error {
+	p.file.Close()
+	p.removeValidator()
+	return os.Remove(p.partialPath())
+}
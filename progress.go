@@ -0,0 +1,419 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/pkg/term"
+)
+
+// Transfer progress. Batches of blob transfers (see putBlobs, getBlobs)
+// start a transferProgress, which each blob transfer reports its bytes
+// to. On terminals, it renders a progress bar (redrawn in place), and
+// otherwise logs progress lines periodically.
+
+// Quiet silences progress output (set by the --quiet flag).
+var Quiet bool
+
+const progressRedraw = 200 * time.Millisecond // progress bar
+const progressLogEvery = 10 * time.Second     // progress lines
+
+// Transfers lasting longer than this report their stats when done.
+const progressBlobStats = time.Second
+
+const progressBarWidth = 20
+
+// Serializes stderr output, so progress bars and other output don't mix.
+var outputLk sync.Mutex
+var progressDrawn bool // a progress bar is on screen
+
+// Clears the progress bar, if any, to print something else.
+// Requires outputLk.
+func clearProgressBar() {
+	if progressDrawn {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		progressDrawn = false
+	}
+}
+
+// The progress of the current batch of transfers. nil if none.
+var progress *transferProgress
+var progressLk sync.Mutex
+
+func currentProgress() *transferProgress {
+	progressLk.Lock()
+	defer progressLk.Unlock()
+	return progress
+}
+
+type transferProgress struct {
+	op    string // e.g. "put blob"
+	start time.Time
+	tty   bool
+
+	lk        sync.Mutex
+	blobs     int   // in this batch
+	blobsDone int   //
+	size      int64 // bytes to transfer, -1 if unknown
+	done      int64 // bytes transferred
+	active    []*blobProgress
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Starts reporting the progress of op, transferring blobs (of size
+// bytes in total, or -1 if unknown). Stop it once done.
+func startProgress(op string, blobs int, size int64) *transferProgress {
+	p := &transferProgress{
+		op:      op,
+		start:   time.Now(),
+		tty:     term.IsTerminal(os.Stderr.Fd()),
+		blobs:   blobs,
+		size:    size,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	progressLk.Lock()
+	progress = p
+	progressLk.Unlock()
+
+	go p.run()
+	return p
+}
+
+func (p *transferProgress) run() {
+	defer close(p.stopped)
+	if Quiet {
+		<-p.stop
+		return
+	}
+
+	every := progressLogEvery
+	if p.tty {
+		every = progressRedraw
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.render()
+		}
+	}
+}
+
+// Stops reporting, and prints the totals.
+func (p *transferProgress) Stop() {
+	progressLk.Lock()
+	if progress == p {
+		progress = nil
+	}
+	progressLk.Unlock()
+
+	close(p.stop)
+	<-p.stopped
+
+	outputLk.Lock()
+	clearProgressBar()
+	outputLk.Unlock()
+
+	p.lk.Lock()
+	done, blobs := p.done, p.blobsDone
+	p.lk.Unlock()
+
+	if done > 0 {
+		elapsed := time.Since(p.start)
+		vErr("%s: %d blobs, %s in %s (%s)\n", p.op, blobs, humanBytes(done),
+			formatDuration(elapsed), formatRate(done, elapsed))
+	}
+}
+
+func (p *transferProgress) render() {
+	p.lk.Lock()
+	done, size := p.done, p.size
+	line := fmt.Sprintf("%s %s, %d/%d blobs", p.op,
+		progressStats(done, size, done, time.Since(p.start)), p.blobsDone, p.blobs)
+
+	blobLines := []string{}
+	if !p.tty {
+		for _, b := range p.active {
+			blobLines = append(blobLines, b.line())
+		}
+	}
+	p.lk.Unlock()
+
+	outputLk.Lock()
+	defer outputLk.Unlock()
+
+	if p.tty {
+		if size > 0 {
+			line = progressBar(done, size) + " " + line
+		}
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s", line)
+		progressDrawn = true
+		return
+	}
+
+	for _, l := range blobLines {
+		fmt.Fprintf(os.Stderr, "%s\n", l)
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", line)
+}
+
+// Progress of one blob transfer.
+type blobProgress struct {
+	p     *transferProgress // nil if no progress is reported
+	name  string            // e.g. "put blob <hash> <path>"
+	start time.Time
+	size  int64 // -1 if unknown
+	done  int64
+	base  int64 // bytes done before starting (e.g. resumed downloads)
+	began bool  // reading began
+}
+
+// Starts reporting the progress of a blob transfer. Call Done once done.
+func (p *transferProgress) startBlob(name string, size int64) *blobProgress {
+	b := &blobProgress{p: p, name: name, start: time.Now(), size: size}
+	if p != nil {
+		p.lk.Lock()
+		p.active = append(p.active, b)
+		p.lk.Unlock()
+	}
+	return b
+}
+
+// Locks b (and its transferProgress), if progress is reported.
+func (b *blobProgress) lock() {
+	if b.p != nil {
+		b.p.lk.Lock()
+	}
+}
+
+func (b *blobProgress) unlock() {
+	if b.p != nil {
+		b.p.lk.Unlock()
+	}
+}
+
+// Sets the bytes transferred so far (e.g. when resuming, or retrying).
+func (b *blobProgress) set(n int64) {
+	b.add(n - b.done)
+}
+
+func (b *blobProgress) add(n int64) {
+	b.lock()
+	defer b.unlock()
+
+	b.done += n
+	if b.p != nil {
+		b.p.done += n
+	}
+}
+
+// Counts a blob needing no transfer (e.g. already uploaded, or cached),
+// of the size of fpath, if any.
+func (p *transferProgress) skipBlob(fpath string) {
+	if p == nil {
+		return
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	p.blobsDone++
+	if len(fpath) > 0 && p.size > 0 {
+		p.size -= fileSize(fpath)
+	}
+}
+
+// Skips n bytes of the blob, needing no transfer (e.g. existing chunks).
+func (b *blobProgress) skip(n int64) {
+	b.lock()
+	defer b.unlock()
+
+	if b.size > 0 {
+		b.size -= n
+	}
+	if b.p != nil && b.p.size > 0 {
+		b.p.size -= n
+	}
+}
+
+// Marks the transfer done, reporting its stats if it took a while.
+func (b *blobProgress) Done() {
+	if b.p == nil {
+		return
+	}
+
+	b.p.lk.Lock()
+	for n, a := range b.p.active {
+		if a == b {
+			b.p.active = append(b.p.active[:n], b.p.active[n+1:]...)
+			break
+		}
+	}
+	b.p.blobsDone++
+	b.p.lk.Unlock()
+
+	elapsed := time.Since(b.start)
+	if elapsed >= progressBlobStats {
+		vErr("%s - %s in %s (%s)\n", b.name, humanBytes(b.done-b.base),
+			formatDuration(elapsed), formatRate(b.done-b.base, elapsed))
+	}
+}
+
+// Requires b.p.lk.
+func (b *blobProgress) line() string {
+	return fmt.Sprintf("%s - %s", b.name,
+		progressStats(b.done, b.size, b.done-b.base, time.Since(b.start)))
+}
+
+// Wraps r, reading the blob from offset, to count what is read. If
+// unknown, the blob size is guessed from r (see readerSize).
+func (b *blobProgress) reader(r io.ReadCloser, offset int64) io.ReadCloser {
+	size := readerSize(r)
+
+	b.lock()
+	if b.size < 0 && size >= 0 {
+		b.size = offset + size
+	}
+	began := b.began
+	if !b.began {
+		b.began = true
+		b.base, b.done = offset, offset // resumed, not transferred now.
+	}
+	b.unlock()
+
+	if began {
+		b.set(offset)
+	}
+	return &progressReader{r, b}
+}
+
+// Wraps f (the blob being uploaded) to count what is read.
+func (b *blobProgress) file(f fileReader) *progressFile {
+	return &progressFile{f, b}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	b *blobProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.b.add(int64(n))
+	return n, err
+}
+
+// progressFile is a fileReader counting what is read. It still seeks and
+// stats (so blobstores can tell its size, and resend it when retrying).
+// (Not an *os.File: copies would bypass Read, with its WriteTo.)
+type progressFile struct {
+	fileReader
+	b *blobProgress
+}
+
+func (f *progressFile) Read(p []byte) (int, error) {
+	n, err := f.fileReader.Read(p)
+	f.b.add(int64(n))
+	return n, err
+}
+
+func (f *progressFile) Seek(offset int64, whence int) (int64, error) {
+	n, err := f.fileReader.Seek(offset, whence)
+	if err == nil {
+		f.b.set(n)
+	}
+	return n, err
+}
+
+// Returns the size of the file at fpath, or 0 if it cannot stat it.
+func fileSize(fpath string) int64 {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Returns the bytes left to read from r, or -1 if unknown.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil {
+			return -1
+		}
+
+		pos, err := r.Seek(0, os.SEEK_CUR)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+
+	case *chunkedBlobReader:
+		n := -r.skip
+		for _, c := range r.chunks {
+			n += c.Size
+		}
+		return n
+
+	case *verifyingReader:
+		return readerSize(r.ReadCloser)
+	}
+	return -1
+}
+
+// e.g. "1.2 GB/2.7 GB (45%), 12.3 MB/s, ETA 2m10s". Rate (and ETA) count
+// only the bytes transferred now.
+func progressStats(done int64, size int64, now int64, elapsed time.Duration) string {
+	s := humanBytes(done)
+	if size > 0 {
+		s += fmt.Sprintf("/%s (%d%%)", humanBytes(size), done*100/size)
+	}
+	s += ", " + formatRate(now, elapsed)
+
+	if size > 0 && now > 0 && done < size {
+		eta := time.Duration(float64(size-done) / float64(now) * float64(elapsed))
+		s += ", ETA " + formatDuration(eta)
+	}
+	return s
+}
+
+// e.g. "[=========>          ]"
+func progressBar(done int64, size int64) string {
+	n := int(done * progressBarWidth / size)
+	if n >= progressBarWidth {
+		return "[" + strings.Repeat("=", progressBarWidth) + "]"
+	}
+	return "[" + strings.Repeat("=", n) + ">" +
+		strings.Repeat(" ", progressBarWidth-n-1) + "]"
+}
+
+func formatRate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- B/s"
+	}
+	return humanBytes(int64(float64(n)/elapsed.Seconds())) + "/s"
+}
+
+// Formats d in whole seconds, e.g. "2m10s".
+func formatDuration(d time.Duration) string {
+	return ((d + time.Second/2) / time.Second * time.Second).String()
+}
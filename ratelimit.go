@@ -0,0 +1,177 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transfer rate limiting. All transfers (on any number of parallel
+// workers) draw from one rateLimiter, so the limit is on the aggregate
+// rate, not per stream. Set by the transfer.limitrate config option, or
+// the --limit-rate flag, e.g. "500k", "2M" (bytes per second).
+
+// A token bucket. Readers take (or go into debt for) the bytes they read,
+// and sleep until the bucket refills.
+type rateLimiter struct {
+	rate  float64 // bytes per second
+	burst float64 // bucket size
+
+	lk     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	burst := float64(rate) / 4 // ~250ms worth
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Takes n bytes, waiting as needed to keep to the rate.
+func (l *rateLimiter) wait(n int) {
+	l.lk.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	// in debt: wait until repaid. later readers queue up behind.
+	d := time.Duration(0)
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lk.Unlock()
+
+	time.Sleep(d)
+}
+
+// The limiter shared by all transfers. nil if unlimited.
+var transferLimiter *rateLimiter
+var transferLimiterOnce sync.Once
+
+func currentRateLimiter() *rateLimiter {
+	transferLimiterOnce.Do(func() {
+		s := ConfigGetString("transfer.limitrate", "")
+		if len(s) == 0 {
+			return
+		}
+
+		rate, err := parseRate(s)
+		if err != nil {
+			pErr("data config: transfer.limitrate %v\n", err)
+			return
+		}
+
+		if rate > 0 {
+			transferLimiter = newRateLimiter(rate)
+		}
+	})
+	return transferLimiter
+}
+
+// Limits all transfers to rate bytes per second (0 for unlimited),
+// overriding the config option.
+func setRateLimit(rate int64) {
+	transferLimiterOnce.Do(func() {})
+	transferLimiter = nil
+	if rate > 0 {
+		transferLimiter = newRateLimiter(rate)
+	}
+}
+
+// Parses a rate in bytes per second, e.g. "800", "500k", "2.5M", "1G".
+// Units are decimal (as humanBytes prints them), and may end in "B"
+// or "B/s".
+func parseRate(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "/s"), "B")
+	mult := float64(1)
+	if len(num) > 0 {
+		switch strings.ToLower(num[len(num)-1:]) {
+		case "k":
+			mult = 1e3
+		case "m":
+			mult = 1e6
+		case "g":
+			mult = 1e9
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid rate: %s (e.g. 500k, 2M)", s)
+	}
+	return int64(f * mult), nil
+}
+
+// throttledReader reads at most at the transfer rate limit.
+type throttledReader struct {
+	io.ReadCloser
+	l *rateLimiter
+}
+
+// Returns r, limited to the transfer rate limit (if any).
+func throttle(r io.ReadCloser) io.ReadCloser {
+	l := currentRateLimiter()
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r, l}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// small reads, so one reader does not take the whole bucket.
+	if len(p) > int(r.l.burst) {
+		p = p[:int(r.l.burst)]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.l.wait(n)
+	return n, err
+}
+
+// throttledFile is a fileReader limited to the transfer rate limit.
+type throttledFile struct {
+	fileReader
+	l *rateLimiter
+}
+
+// Returns f, limited to the transfer rate limit (if any).
+func throttleFile(f fileReader) fileReader {
+	l := currentRateLimiter()
+	if l == nil {
+		return f
+	}
+	return &throttledFile{f, l}
+}
+
+func (f *throttledFile) Read(p []byte) (int, error) {
+	if len(p) > int(f.l.burst) {
+		p = p[:int(f.l.burst)]
+	}
+
+	n, err := f.fileReader.Read(p)
+	f.l.wait(n)
+	return n, err
+}
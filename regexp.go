@@ -19,7 +19,8 @@ var NonIdentRegexp *regexp.Regexp
 func init() {
 	identRE := "[A-Za-z0-9-_.]+"
 	pathRE := "((" + identRE + ")/(" + identRE + "))"
-	handleRE := pathRE + "(\\." + identRE + ")?(@" + identRE + ")?"
+	versionRE := "(?:" + identRE + ":)?" + identRE // may be <algorithm>:<hash>
+	handleRE := pathRE + "(\\." + identRE + ")?(@" + versionRE + ")?"
 	emailRE := `(?i)[A-Z0-9._%+-]+@(?:[A-Z0-9-]+\.)+[A-Z]{2,6}`
 	nonIdentRE := "[^A-Za-z0-9-_.]+"
 
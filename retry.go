@@ -0,0 +1,236 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors from remote services, by kind. Callers switch on these types,
+// rather than matching error strings.
+
+// The requested thing (dataset, ref, blob, ...) does not exist.
+type NotFoundError struct {
+	Err error
+}
+
+// The user lacks permission (or credentials) for the request.
+type ForbiddenError struct {
+	Err error
+}
+
+// The request failed, but may succeed if tried again (network errors,
+// server errors, rate limiting).
+type TransientError struct {
+	Err error
+
+	// How long the server asked us to wait (Retry-After). 0 if unset.
+	RetryAfter time.Duration
+
+	// Whether it was already retried (see RetryPolicy.Do), and should not
+	// be again (e.g. by callers retrying whole operations).
+	Retried bool
+}
+
+func (e *NotFoundError) Error() string  { return e.Err.Error() }
+func (e *ForbiddenError) Error() string { return e.Err.Error() }
+func (e *TransientError) Error() string { return e.Err.Error() }
+
+// Returns the error of an unsuccessful response, typed by status code.
+func httpStatusError(resp *http.Response) error {
+	e, _ := ioutil.ReadAll(resp.Body)
+	s := strings.TrimSpace(string(e[:]))
+	err := fmt.Errorf("HTTP error status code: %d (%s)", resp.StatusCode, s)
+	return typedStatusError(resp.StatusCode, err, retryAfter(resp))
+}
+
+func typedStatusError(code int, err error, wait time.Duration) error {
+	switch {
+	case code == http.StatusNotFound:
+		return &NotFoundError{err}
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return &ForbiddenError{err}
+	case code == http.StatusRequestTimeout, code == 429, code >= 500:
+		return &TransientError{Err: err, RetryAfter: wait}
+	}
+	return err
+}
+
+// Network failures (refused connections, timeouts, dropped transfers)
+// are transient.
+func netError(err error) error {
+	switch e := err.(type) {
+	case nil, *NotFoundError, *ForbiddenError, *TransientError:
+		return err
+	case *url.Error:
+		// only network failures. bad urls, schemes, or certificates are not.
+		_, transient := netError(e.Err).(*TransientError)
+		if transient || e.Err == io.EOF {
+			return &TransientError{Err: err}
+		}
+		return err
+	case net.Error:
+		return &TransientError{Err: err}
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return &TransientError{Err: err}
+	}
+	return err
+}
+
+// Parses the Retry-After header: seconds, or a date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if len(v) == 0 {
+		return 0
+	}
+
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+// RetryPolicy retries operations failing with TransientErrors, waiting
+// exponentially longer (Backoff, 2*Backoff, ... up to MaxBackoff) between
+// attempts, or as long as the server asks (Retry-After). Errors are
+// retried once: those already retried (e.g. by doHttpRequest, within a
+// retried download) are not retried again.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   5,
+	Backoff:    1 * time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+var retryPolicy *RetryPolicy
+var retryPolicyOnce sync.Once
+
+// Returns the retry policy, configured by:
+//
+//	retry.attempts     total attempts (1 disables retrying)
+//	retry.backoff      wait before the first retry (e.g. 500ms)
+//	retry.maxbackoff   longest wait between retries (e.g. 1m)
+func configRetryPolicy() *RetryPolicy {
+	retryPolicyOnce.Do(func() {
+		p := DefaultRetryPolicy
+		p.Attempts = ConfigGetInt("retry.attempts", p.Attempts)
+		p.Backoff = configGetDuration("retry.backoff", p.Backoff)
+		p.MaxBackoff = configGetDuration("retry.maxbackoff", p.MaxBackoff)
+		retryPolicy = &p
+	})
+	return retryPolicy
+}
+
+func configGetDuration(key string, default_ time.Duration) time.Duration {
+	s := ConfigGetString(key, "")
+	if len(s) == 0 {
+		return default_
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		pErr("data config: %s is not a duration (%s).\n", key, s)
+		return default_
+	}
+	return d
+}
+
+// Calls op until it succeeds, fails with a non-transient error, or runs
+// out of attempts. op receives the attempt number (starting at 0).
+func (p *RetryPolicy) Do(op func(attempt int) error) error {
+	wait := p.Backoff
+	for attempt := 0; ; attempt++ {
+		err := op(attempt)
+		terr, transient := err.(*TransientError)
+		if !transient || terr.Retried {
+			return err
+		}
+
+		if attempt+1 >= p.Attempts {
+			terr.Retried = true
+			return err
+		}
+
+		// honor the server's wishes. otherwise, jitter to spread out retries.
+		d := terr.RetryAfter
+		if d <= 0 {
+			d = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+			if d > p.MaxBackoff {
+				d = p.MaxBackoff
+			}
+		}
+
+		dErr("retrying in %v (attempt %d/%d): %v\n", d, attempt+2, p.Attempts, err)
+		time.Sleep(d)
+
+		wait *= 2
+		if wait > p.MaxBackoff {
+			wait = p.MaxBackoff
+		}
+	}
+}
+
+// Does req, retrying network errors and transient http statuses.
+// Other responses are returned as they are, whatever their status.
+func doHttpRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var resp *http.Response
+	err := configRetryPolicy().Do(func(attempt int) error {
+
+		// resend the body, if we can.
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return fmt.Errorf("%s %s: cannot resend request body", req.Method, req.URL)
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
+
+		r, err := client.Do(req)
+		if err != nil {
+			return netError(err)
+		}
+
+		c := r.StatusCode
+		if c == http.StatusRequestTimeout || c == 429 || c >= 500 {
+			defer r.Body.Close()
+			return httpStatusError(r)
+		}
+
+		resp = r
+		return nil
+	})
+
+	return resp, err
+}
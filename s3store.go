@@ -6,9 +6,20 @@ Sniperkit-Bot
 package data
 
 import (
+	"bufio"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jbenet/s3"
 	"github.com/jbenet/s3/s3util"
@@ -16,8 +27,21 @@ import (
 
 type S3Store struct {
 	bucket string
-	domain string
+	domain string // endpoint host[:port]
+
+	// use https. off by default, as dotted bucket names (datadex.archives)
+	// do not match the wildcard certificate with virtual-host addressing.
+	secure bool
+
+	// address buckets as <domain>/<bucket> rather than <bucket>.<domain>
+	// (needed by most S3 stand-ins, e.g. MinIO, Ceph RGW)
+	pathStyle bool
+
 	config *s3util.Config
+	lk     sync.RWMutex // guards config (credentials)
+
+	// serializes requesting credentials from the index.
+	credsLk sync.Mutex
 
 	// used for auth credentials
 	dataIndex *DataIndex
@@ -30,7 +54,34 @@ type AwsCredentials struct {
 	AccessKeyId     string
 }
 
+func init() {
+	registerBlobStore("s3", newS3StoreFromUrl)
+}
+
+// s3://<bucket>[?<option>=<value>&...]
+//
+// Options given in the url (see configure) replace the index config's, so
+// stores other than the index's (e.g. data blob sync --from, --to) are
+// configured independently. s3://<bucket>? uses the defaults.
+func newS3StoreFromUrl(u *url.URL, index *DataIndex) (blobStore, error) {
+	var opts s3Options
+	if len(u.RawQuery) > 0 || u.ForceQuery {
+		opts = u.Query().Get
+	}
+
+	s, err := newS3Store(u.Host, index, opts)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 func NewS3Store(bucket string, index *DataIndex) (*S3Store, error) {
+	return newS3Store(bucket, index, nil)
+}
+
+// opts defaults to the index config options.
+func newS3Store(bucket string, index *DataIndex, opts s3Options) (*S3Store, error) {
 
 	if len(bucket) < 1 {
 		return nil, fmt.Errorf("Invalid (empty) S3 Bucket name.")
@@ -40,9 +91,13 @@ func NewS3Store(bucket string, index *DataIndex) (*S3Store, error) {
 		return nil, fmt.Errorf("Invalid (nil) DataIndex.")
 	}
 
+	if opts == nil {
+		opts = s3IndexOptions(index.Name)
+	}
+
 	s := &S3Store{
 		bucket:    bucket,
-		domain:    "s3.amazonaws.com",
+		domain:    DefaultS3Domain,
 		dataIndex: index,
 	}
 
@@ -51,10 +106,108 @@ func NewS3Store(bucket string, index *DataIndex) (*S3Store, error) {
 		Keys:    new(s3.Keys),
 	}
 
+	s.configure(opts)
+
+	// static credentials take precedence over requesting index ones.
+	c, err := staticAwsCredentials(opts.profile())
+	if err != nil {
+		return nil, fmt.Errorf("aws credentials error: %v", err)
+	}
+	if c != nil {
+		s.SetAwsCredentials(c)
+	}
+
 	return s, nil
 }
 
+const DefaultS3Domain = "s3.amazonaws.com"
+
+// Returns the value of a store option ("" if unset).
+type s3Options func(option string) string
+
+// Options from the index config (index.<name>.s3.<option>).
+func s3IndexOptions(index string) s3Options {
+	return func(option string) string {
+		val := ConfigGet(fmt.Sprintf("index.%s.s3.%s", index, option))
+		if val == nil {
+			return ""
+		}
+		return fmt.Sprint(val)
+	}
+}
+
+func (o s3Options) bool(option string, default_ bool) bool {
+	val := o(option)
+	if len(val) == 0 {
+		return default_
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		pErr("s3 store: %s is not a boolean (%s).\n", option, val)
+		return default_
+	}
+	return b
+}
+
+func (o s3Options) profile() string {
+	p := o("profile")
+	if len(p) == 0 {
+		p = os.Getenv("AWS_PROFILE")
+	}
+	if len(p) == 0 {
+		p = "default"
+	}
+	return p
+}
+
+// Reads the store options:
+//
+//	endpoint    host[:port] of the S3 service
+//	region      region (default endpoint s3.<region>.amazonaws.com)
+//	tls         use https (default false)
+//	pathstyle   use path-style bucket urls (default false)
+//	profile     ~/.aws/credentials profile to use
+//
+// Requests are signed with AWS signature version 2, so regions that only
+// accept version 4 (e.g. eu-central-1, and those opened since 2014) refuse
+// them (403). Setting region only picks the endpoint.
+func (s *S3Store) configure(opts s3Options) {
+	if region := opts("region"); len(region) > 0 {
+		s.domain = fmt.Sprintf("s3.%s.amazonaws.com", region)
+	}
+
+	endpoint := opts("endpoint")
+	if len(endpoint) > 0 {
+		// tolerate urls. the scheme chooses tls unless set explicitly.
+		switch {
+		case strings.HasPrefix(endpoint, "https://"):
+			s.secure = true
+		case strings.HasPrefix(endpoint, "http://"):
+			s.secure = false
+		}
+		endpoint = strings.TrimPrefix(endpoint, "https://")
+		endpoint = strings.TrimPrefix(endpoint, "http://")
+		s.domain = strings.TrimSuffix(endpoint, "/")
+	}
+
+	s.secure = opts.bool("tls", s.secure)
+	s.pathStyle = opts.bool("pathstyle", s.pathStyle)
+
+	// requests are signed against the endpoint host (sans port).
+	if s.domain != DefaultS3Domain {
+		host := s.domain
+		if i := strings.Index(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		s.config.Service = &s3.Service{Domain: host}
+	}
+}
+
 func (s *S3Store) SetAwsCredentials(c *AwsCredentials) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
 	s.config.AccessKey = c.AccessKeyId
 	s.config.SecretKey = c.SecretAccessKey
 	s.config.SecurityToken = c.SessionToken
@@ -66,6 +219,9 @@ func (s *S3Store) SetAwsCredentials(c *AwsCredentials) {
 }
 
 func (s *S3Store) AwsCredentials() *AwsCredentials {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
 	if s.config == nil || len(s.config.AccessKey) == 0 {
 		return nil
 	}
@@ -81,53 +237,313 @@ func (s *S3Store) Url(key string) string {
 	if !strings.HasPrefix(key, "/") {
 		key = "/" + key
 	}
-	return fmt.Sprintf("http://%s.%s%s", s.bucket, s.domain, key)
+
+	scheme := "http"
+	if s.secure {
+		scheme = "https"
+	}
+
+	if s.pathStyle {
+		return fmt.Sprintf("%s://%s/%s%s", scheme, s.domain, s.bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s%s", scheme, s.bucket, s.domain, key)
 }
 
 func (s *S3Store) Has(key string) (bool, error) {
-	url := s.Url(key)
-	rc, err := s3util.Open(url, s.config)
+	_, exists, err := s.Stat(key)
+	return exists, err
+}
 
-	if err == nil {
-		rc.Close()
-		return true, nil
+func (s *S3Store) Stat(key string) (int64, bool, error) {
+	req, err := s.newRequest("HEAD", key)
+	if err != nil {
+		return 0, false, err
 	}
 
-	if strings.Contains(err.Error(), "unwanted http status 404:") {
-		return false, nil
+	resp, err := s.doRequest(req)
+	if err != nil {
+		return 0, false, err
 	}
-
-	return false, err
+	defer resp.Body.Close()
+
+	c := resp.StatusCode
+	switch {
+	case 200 <= c && c < 300:
+		return resp.ContentLength, true, nil
+	case c == http.StatusNotFound:
+		return 0, false, nil
+	}
+	return 0, false, s3StatusError(resp)
 }
 
 func (s *S3Store) Put(key string, value io.Reader) error {
+	return s.PutEncoded(key, value, CodecNone)
+}
+
+// Puts value, encoded with codec (kept in the object metadata). Retried
+// if value can be rewound (e.g. files).
+func (s *S3Store) PutEncoded(key string, value io.Reader, codec string) error {
 	err := s.ensureUserAwsCredentials()
 	if err != nil {
 		return fmt.Errorf("aws credentials error: %v", err)
 	}
 
+	header := http.Header{}
+	if codec != CodecNone {
+		header.Set(CodecHeader, codec)
+	}
+
+	seeker, ok := value.(io.Seeker)
+	if !ok {
+		return s.put(key, value, header)
+	}
+
+	start, err := seeker.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return s.put(key, value, header)
+	}
+
+	return configRetryPolicy().Do(func(attempt int) error {
+		if attempt > 0 {
+			if _, err := seeker.Seek(start, os.SEEK_SET); err != nil {
+				return err
+			}
+		}
+		return s.put(key, value, header)
+	})
+}
+
+func (s *S3Store) put(key string, value io.Reader, header http.Header) error {
 	url := s.Url(key)
-	w, err := s3util.Create(url, nil, s.config)
+	dOut("s3 put %s\n", url)
+	w, err := s3util.Create(url, header, s.snapshot())
 	if err != nil {
-		return err
+		return s3Error(err)
 	}
 
 	_, err = io.Copy(w, value)
+	if err != nil {
+		w.Close()
+		return s3Error(err)
+	}
+
+	return s3Error(w.Close())
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, s3StatusError(resp)
+}
+
+func (s *S3Store) GetEncoded(key string, offset int64) (io.ReadCloser, string, error) {
+	return getEncodedResponse(func(offset int64) (*http.Response, error) {
+		req, err := s.newRequest("GET", key)
+		if err != nil {
+			return nil, err
+		}
+
+		if offset > 0 {
+			req.Header.Set("Range", httpRange(offset, -1))
+		}
+
+		resp, err := s.doRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		c := resp.StatusCode
+		if c == http.StatusOK || c == http.StatusPartialContent {
+			return resp, nil
+		}
+
+		defer resp.Body.Close()
+		return nil, s3StatusError(resp)
+	}, offset)
+}
+
+func (s *S3Store) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	req, err := s.newRequest("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", httpRange(offset, length))
+
+	resp, err := s.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		r, err := rangeResponseBody(resp, offset)
+		if err != nil || length < 0 {
+			return r, err
+		}
+		return &limitedReadCloser{io.LimitReader(r, length), r}, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, s3StatusError(resp)
+}
+
+// Lists the bucket (ListObjects), a page at a time.
+func (s *S3Store) List(prefix string, fn func(key string, size int64, modified time.Time) error) error {
+	marker := ""
+	for {
+		req, err := s.newRequest("GET", "/")
+		if err != nil {
+			return err
+		}
+
+		q := url.Values{}
+		q.Set("prefix", strings.TrimPrefix(prefix, "/"))
+		if len(marker) > 0 {
+			q.Set("marker", marker)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		resp, err := s.doRequest(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return s3StatusError(resp)
+		}
+
+		page := &s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, o := range page.Contents {
+			if err := fn("/"+o.Key, o.Size, o.LastModified); err != nil {
+				return err
+			}
+			marker = o.Key
+		}
+
+		if !page.IsTruncated || len(page.Contents) == 0 {
+			return nil
+		}
+
+		if len(page.NextMarker) > 0 {
+			marker = page.NextMarker
+		}
+	}
+}
+
+type s3ListResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func (s *S3Store) Delete(key string) error {
+	err := s.ensureUserAwsCredentials()
+	if err != nil {
+		return fmt.Errorf("aws credentials error: %v", err)
+	}
+
+	req, err := s.newRequest("DELETE", key)
 	if err != nil {
 		return err
 	}
 
-	err = w.Close()
+	resp, err := s.doRequest(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	return nil
+	c := resp.StatusCode
+	if (200 <= c && c < 300) || c == http.StatusNotFound {
+		return nil
+	}
+	return s3StatusError(resp)
 }
 
-func (s *S3Store) Get(key string) (io.ReadCloser, error) {
-	url := s.Url(key)
-	return s3util.Open(url, s.config)
+// s3util only covers plain GETs and PUTs. Other requests are built here,
+// and signed the same way.
+func (s *S3Store) newRequest(method string, key string) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.Url(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	return req, nil
+}
+
+func (s *S3Store) doRequest(req *http.Request) (*http.Response, error) {
+	c := s.snapshot()
+	if len(c.AccessKey) > 0 { // anonymous otherwise
+		c.Sign(req, *c.Keys)
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	dOut("s3 %s %s\n", strings.ToLower(req.Method), req.URL)
+	return doHttpRequest(client, req)
+}
+
+// Same format as s3util errors.
+func s3StatusError(resp *http.Response) error {
+	e, _ := ioutil.ReadAll(resp.Body)
+	err := fmt.Errorf("unwanted http status %d: %q", resp.StatusCode, e)
+	return typedStatusError(resp.StatusCode, err, retryAfter(resp))
+}
+
+// Types the (untyped) errors s3util returns.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var code int
+	if _, serr := fmt.Sscanf(err.Error(), "unwanted http status %d:", &code); serr == nil {
+		return typedStatusError(code, err, 0)
+	}
+	return netError(err)
+}
+
+// Returns a copy of the config, for use by concurrent requests.
+func (s *S3Store) snapshot() *s3util.Config {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+
+	keys := *s.config.Keys
+	return &s3util.Config{
+		Service: s.config.Service,
+		Keys:    &keys,
+		Client:  s.config.Client,
+	}
 }
 
 func (s *S3Store) getUserAwsCredentials() error {
@@ -147,6 +563,9 @@ func (s *S3Store) getUserAwsCredentials() error {
 }
 
 func (s *S3Store) ensureUserAwsCredentials() error {
+	s.credsLk.Lock()
+	defer s.credsLk.Unlock()
+
 	// if we already have credentials, do nothing.
 	if s.AwsCredentials() != nil {
 		return nil
@@ -154,3 +573,88 @@ func (s *S3Store) ensureUserAwsCredentials() error {
 
 	return s.getUserAwsCredentials()
 }
+
+// Looks for credentials set outside of data: first in the environment
+// (AWS_ACCESS_KEY_ID, ...), then in the shared credentials file
+// (~/.aws/credentials). Returns nil if there are none.
+func staticAwsCredentials(profile string) (*AwsCredentials, error) {
+	c := &AwsCredentials{
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if len(c.AccessKeyId) > 0 {
+		return c, nil
+	}
+
+	fpath := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if len(fpath) == 0 {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		fpath = filepath.Join(usr.HomeDir, ".aws", "credentials")
+	}
+
+	f, err := os.Open(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return readAwsCredentialsFile(f, profile)
+}
+
+// Parses the INI-style credentials file format:
+//
+//	[default]
+//	aws_access_key_id = ...
+//	aws_secret_access_key = ...
+//	aws_session_token = ...
+func readAwsCredentialsFile(r io.Reader, profile string) (*AwsCredentials, error) {
+	c := &AwsCredentials{}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 0, line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		if section != profile {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		v := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "aws_access_key_id":
+			c.AccessKeyId = v
+		case "aws_secret_access_key":
+			c.SecretAccessKey = v
+		case "aws_session_token":
+			c.SessionToken = v
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(c.AccessKeyId) == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
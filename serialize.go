@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 
 	"launchpad.net/goyaml"
 )
@@ -21,13 +22,28 @@ type SerializedFile struct {
 	Format interface{} "-"
 }
 
+// Formats with several serialized forms (e.g. versions) convert to and
+// from theirs.
+type serialFormat interface {
+	serialForm() interface{}
+	readSerialForm(buf []byte) error
+}
+
 func (f *SerializedFile) Marshal() ([]byte, error) {
 	dOut("Marshalling %s\n", f.Path)
+	if sf, ok := f.Format.(serialFormat); ok {
+		return goyaml.Marshal(sf.serialForm())
+	}
 	return goyaml.Marshal(f.Format)
 }
 
 func (f *SerializedFile) Unmarshal(buf []byte) error {
-	err := goyaml.Unmarshal(buf, f.Format)
+	var err error
+	if sf, ok := f.Format.(serialFormat); ok {
+		err = sf.readSerialForm(buf)
+	} else {
+		err = goyaml.Unmarshal(buf, f.Format)
+	}
 	if err != nil {
 		return err
 	}
@@ -70,7 +86,48 @@ func (f *SerializedFile) WriteFile() error {
 		return err
 	}
 
-	return ioutil.WriteFile(f.Path, buf, 0666)
+	// write through symlinks (e.g. a linked config), keeping them.
+	target := f.Path
+	if resolved, err := filepath.EvalSymlinks(f.Path); err == nil {
+		target = resolved
+	}
+
+	// write whole, then rename over: readers (and crashes) never see
+	// a partially written file. the temp file is hidden (not listed in
+	// manifests, if left behind), and keeps the file's mode (e.g. 0600
+	// for secrets).
+	dir, name := filepath.Split(target)
+	tmp := filepath.Join(dir, fmt.Sprintf(".%s.%d.tmp", name, os.Getpid()))
+	err = writeFileSync(tmp, buf, 0666)
+	if err == nil {
+		if fi, serr := os.Stat(target); serr == nil {
+			err = os.Chmod(tmp, fi.Mode().Perm())
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, target)
+}
+
+// Like ioutil.WriteFile, but syncs the file to disk before closing it.
+func writeFileSync(filename string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (f *SerializedFile) ReadFile() error {
@@ -92,10 +149,15 @@ func (f *SerializedFile) ReadBlob(ref string) error {
 		return err
 	}
 
-	r, err := i.BlobStore.Get(BlobKey(ref))
+	return f.ReadBlobFrom(i, ref)
+}
+
+func (f *SerializedFile) ReadBlobFrom(i *DataIndex, ref string) error {
+	r, err := i.findBlob(ref)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	err = f.Read(r)
 	if err != nil {
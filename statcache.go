@@ -0,0 +1,162 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"os"
+	"time"
+)
+
+// The stat cache records the size, mtime, and inode of files when they
+// were hashed, to tell which files changed since (and need rehashing),
+// without reading them. It is kept locally, alongside the manifest, and
+// is not part of the dataset.
+const StatCacheFileName = ".data/StatCache"
+
+// Files modified this recently may change again within the same mtime
+// tick, unnoticed. They are not trusted to be unchanged.
+const statCacheRacyWindow = 2 * time.Second
+
+// serializable into YAML
+type FileStat struct {
+	Hash  string
+	Size  int64
+	Mtime int64  // unix nanoseconds
+	Inode uint64 ",omitempty"
+}
+
+func newFileStat(hash string, fi os.FileInfo) FileStat {
+	return FileStat{
+		Hash:  hash,
+		Size:  fi.Size(),
+		Mtime: fi.ModTime().UnixNano(),
+		Inode: fileInode(fi),
+	}
+}
+
+// Returns whether the file stat-ed by fi still hashes to hash (as recorded
+// in s, i.e. it is unchanged since).
+func (s FileStat) Unchanged(hash string, fi os.FileInfo) bool {
+	return s.Hash == hash && newFileStat(hash, fi) == s
+}
+
+type StatCache struct {
+	SerializedFile "-"
+	Files          map[string]FileStat ""
+
+	changed bool
+	missing bool // no cache file yet. see Seed.
+}
+
+func NewStatCache(path string) *StatCache {
+	sc := &StatCache{SerializedFile: SerializedFile{Path: path}}
+
+	// initialize map
+	sc.Files = map[string]FileStat{}
+	sc.SerializedFile.Format = sc.Files
+
+	// attempt to load
+	if len(path) > 0 {
+		_, err := os.Stat(path)
+		sc.missing = os.IsNotExist(err)
+		sc.ReadFile()
+	}
+	return sc
+}
+
+func NewDefaultStatCache() *StatCache {
+	return NewStatCache(StatCacheFileName)
+}
+
+// Returns whether the file at path is known to still hash to hash (its
+// size, mtime, and inode are unchanged since).
+func (sc *StatCache) Fresh(path string, hash string) bool {
+	s, found := sc.Files[path]
+	if !found || s.Hash != hash {
+		return false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return s.Unchanged(hash, fi)
+}
+
+// Returns whether the file at path may have changed since it hashed to
+// hash. Missing files are not modified (they are missing). Files not in
+// the cache (e.g. hashed before it existed, or while recently modified)
+// may have.
+func (sc *StatCache) Modified(path string, hash string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	s, found := sc.Files[path]
+	return !found || !s.Unchanged(hash, fi)
+}
+
+// Records that the file at path (as stat-ed by fi, before hashing) hashed
+// to hash. Recently modified files are not recorded (see statCacheRacyWindow).
+func (sc *StatCache) Set(path string, hash string, fi os.FileInfo) {
+	if time.Since(fi.ModTime()) < statCacheRacyWindow {
+		sc.Remove(path)
+		return
+	}
+
+	sc.Files[path] = newFileStat(hash, fi)
+	sc.changed = true
+}
+
+// Records files (as they are now) as hashing to their known hashes,
+// without rehashing them: files just downloaded (and verified), or hashed
+// before the dataset had a stat cache (whose changes since go unnoticed,
+// as they did then).
+func (sc *StatCache) Seed(files blobPaths) {
+	for path, hash := range files {
+		if !IsHash(hash) || hash == noHash {
+			continue
+		}
+
+		if fi, err := os.Stat(path); err == nil {
+			sc.Set(path, hash, fi)
+		}
+	}
+
+	// written even if empty: seeded once.
+	sc.missing = false
+	sc.changed = true
+}
+
+func (sc *StatCache) Remove(path string) {
+	if _, found := sc.Files[path]; found {
+		delete(sc.Files, path)
+		sc.changed = true
+	}
+}
+
+// Removes files not in files.
+func (sc *StatCache) Prune(files blobPaths) {
+	for path := range sc.Files {
+		if _, found := files[path]; !found {
+			sc.Remove(path)
+		}
+	}
+}
+
+// Writes the cache, if it changed.
+func (sc *StatCache) Flush() error {
+	if !sc.changed {
+		return nil
+	}
+
+	err := sc.WriteFile()
+	if err == nil {
+		sc.changed = false
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"os"
+)
+
+// Inodes are unknown here: files are told apart by size and mtime.
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
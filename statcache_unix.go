@@ -0,0 +1,21 @@
+//go:build unix
+
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode of the file stat-ed by fi.
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
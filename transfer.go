@@ -0,0 +1,166 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jbenet/commander"
+)
+
+// Number of concurrent blob transfers (and existence checks), unless set
+// by the transfer.jobs config option, or the --jobs flag.
+const DefaultJobs = 4
+
+func configJobs() int {
+	return ConfigGetInt("transfer.jobs", DefaultJobs)
+}
+
+const jobsFlagUsage = "concurrent transfers (default: transfer.jobs config)"
+const quietFlagUsage = "no transfer progress output"
+const limitRateFlagUsage = "max transfer rate, e.g. 2M (default: transfer.limitrate config)"
+
+// Applies transfer flags (if defined by command c) to the main index.
+func transferFlags(c *commander.Command) error {
+	di, err := NewMainDataIndex()
+	if err != nil {
+		return err
+	}
+
+	if f := c.Flag.Lookup("jobs"); f != nil {
+		if n := f.Value.Get().(int); n > 0 {
+			di.Jobs = n
+		}
+	}
+
+	if f := c.Flag.Lookup("quiet"); f != nil {
+		Quiet = f.Value.Get().(bool)
+	}
+
+	if f := c.Flag.Lookup("limit-rate"); f != nil {
+		if s := f.Value.Get().(string); len(s) > 0 {
+			rate, err := parseRate(s)
+			if err != nil {
+				return fmt.Errorf("%v: --limit-rate %v", c.FullName(), err)
+			}
+			setRateLimit(rate)
+		}
+	}
+
+	return nil
+}
+
+// Calls fn(n) for every n in [0, count), on up to jobs goroutines.
+// Every call is made, regardless of failures. Returns all errors.
+func parallel(count int, jobs int, fn func(n int) error) []error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	errs := []error{}
+
+	next := make(chan int)
+	for w := 0; w < jobs && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				if err := fn(n); err != nil {
+					lk.Lock()
+					errs = append(errs, err)
+					lk.Unlock()
+				}
+			}
+		}()
+	}
+
+	for n := 0; n < count; n++ {
+		next <- n
+	}
+	close(next)
+
+	wg.Wait()
+	return errs
+}
+
+// Calls work(n) for every n in [0, count), on up to jobs goroutines, and
+// done(n) as each result is ready, in order of n, on the calling goroutine
+// (e.g. to record results in order, with a single writer). Stops at the
+// first error done returns.
+func orderedParallel(count int, jobs int, work func(n int), done func(n int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ready := make([]chan struct{}, count)
+	for n := range ready {
+		ready[n] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < jobs && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				work(n)
+				close(ready[n])
+			}
+		}()
+	}
+
+	quit := make(chan struct{})
+	go func() {
+		defer close(next)
+		for n := 0; n < count; n++ {
+			select {
+			case next <- n:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for n := 0; n < count && err == nil; n++ {
+		<-ready[n]
+		err = done(n)
+	}
+
+	close(quit)
+	wg.Wait()
+	return err
+}
+
+// Errors of a batch of blob transfers.
+type transferErrors struct {
+	Op     string // e.g. "put blob"
+	Total  int
+	Errors []error
+}
+
+// Returns transferErrors if any errs, nil otherwise.
+func newTransferErrors(op string, total int, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &transferErrors{Op: op, Total: total, Errors: errs}
+}
+
+func (e *transferErrors) Error() string {
+	lines := []string{
+		fmt.Sprintf("%s: %d/%d failed:", e.Op, len(e.Errors), e.Total),
+	}
+	for _, err := range e.Errors {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -8,14 +8,19 @@ package data
 import (
 	"bufio"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -30,6 +35,10 @@ var NotImplementedError = fmt.Errorf("Error: not implemented yet.")
 
 // Shorthand printing functions.
 func pErr(format string, a ...interface{}) {
+	outputLk.Lock()
+	defer outputLk.Unlock()
+
+	clearProgressBar()
 	fmt.Fprintf(os.Stderr, format, a...)
 }
 
@@ -49,6 +58,13 @@ func dOut(format string, a ...interface{}) {
 	}
 }
 
+// Transfer status. Silenced by --quiet.
+func vErr(format string, a ...interface{}) {
+	if !Quiet {
+		pErr(format, a...)
+	}
+}
+
 // human-readable time ago
 func TimeAgo(s string) string {
 	t, _ := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
@@ -72,13 +88,46 @@ func VersionLess(i, j string) bool {
 	return i < j
 }
 
-// Checks whether string is a hash (sha1)
+// Hash algorithms. Hashes are written "<algorithm>:<hex digest>", except
+// sha1 hashes, which are bare hex digests (as they predate the tags).
+const (
+	HashSha1   = "sha1"
+	HashSha256 = "sha256"
+)
+
+// The algorithm used to hash new blobs.
+const DefaultHashAlgorithm = HashSha256
+
+// map { algorithm : hex digest length }
+var hashDigestLengths = map[string]int{
+	HashSha1:   40,
+	HashSha256: 64,
+}
+
+// Splits hash into algorithm and hex digest.
+func splitHash(hash string) (string, string) {
+	i := strings.Index(hash, ":")
+	if i < 0 {
+		return HashSha1, hash
+	}
+	return hash[:i], hash[i+1:]
+}
+
+// Returns the algorithm hash was computed with.
+func hashAlgorithm(hash string) string {
+	algo, _ := splitHash(hash)
+	return algo
+}
+
+// Checks whether string is a hash (sha1, or tagged hash)
 func IsHash(hash string) bool {
-	if len(hash) != 40 {
+	algo, digest := splitHash(hash)
+	length, known := hashDigestLengths[algo]
+	if !known || len(digest) != length {
 		return false
 	}
 
-	for _, r := range hash {
+	for _, r := range digest {
 		if !unicode.Is(unicode.ASCII_Hex_Digit, r) {
 			return false
 		}
@@ -88,21 +137,48 @@ func IsHash(hash string) bool {
 }
 
 func shortHash(hash string) string {
-	return hash[:7]
+	_, digest := splitHash(hash)
+	return slice(digest, 0, 7)
+}
+
+func newHasher(algo string) (hash.Hash, error) {
+	switch algo {
+	case HashSha1:
+		return sha1.New(), nil
+	case HashSha256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algo)
+}
+
+// Returns the hash string for digest sum.
+func formatHash(algo string, sum []byte) string {
+	if algo == HashSha1 {
+		return fmt.Sprintf("%x", sum)
+	}
+	return fmt.Sprintf("%s:%x", algo, sum)
 }
 
 func readerHash(r io.Reader) (string, error) {
+	return readerHashAlgo(r, DefaultHashAlgorithm)
+}
+
+func readerHashAlgo(r io.Reader, algo string) (string, error) {
+	h, err := newHasher(algo)
+	if err != nil {
+		return "", err
+	}
+
 	bf := bufio.NewReader(r)
-	h := sha1.New()
-	_, err := bf.WriteTo(h)
+	_, err = bf.WriteTo(h)
 	if err != nil {
 		return "", err
 	}
 
-	hex := fmt.Sprintf("%x", h.Sum(nil))
-	return hex, nil
+	return formatHash(algo, h.Sum(nil)), nil
 }
 
+// Note: stays sha1. Used for password hashes, which the index expects.
 func StringHash(s string) (string, error) {
 	r := strings.NewReader(s)
 	h := sha1.New()
@@ -116,13 +192,23 @@ func StringHash(s string) (string, error) {
 }
 
 func hashFile(path string) (string, error) {
+	return hashFileAlgo(path, DefaultHashAlgorithm)
+}
+
+// Hashes file at path with the same algorithm as hash. Use this to verify
+// contents against an existing hash.
+func hashFileAs(path string, hash string) (string, error) {
+	return hashFileAlgo(path, hashAlgorithm(hash))
+}
+
+func hashFileAlgo(path string, algo string) (string, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	return readerHash(f)
+	return readerHashAlgo(f, algo)
 }
 
 func catFile(path string) error {
@@ -142,6 +228,48 @@ func copyFile(src string, dst string) error {
 	return cmd.Run()
 }
 
+// copy-on-write copy. fails where the filesystem does not support it.
+func reflinkFile(src string, dst string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.Command("cp", "--reflink=always", src, dst)
+	case "darwin":
+		cmd = exec.Command("cp", "-c", src, dst)
+	default:
+		return NotImplementedError
+	}
+	return cmd.Run()
+}
+
+// expand leading ~/ to the user's home directory
+func expandUser(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return p
+	}
+	return path.Join(usr.HomeDir, p[2:])
+}
+
+// human-readable byte size (1.5 MB)
+func humanBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
 // clean up ident string
 func identString(ident string) string {
 	return NonIdentRegexp.ReplaceAllString(ident, "")
@@ -189,7 +317,12 @@ func isUrl(str string) bool {
 }
 
 func httpExists(url string) (bool, error) {
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := doHttpRequest(nil, req)
 	if err != nil {
 		return false, err
 	}
@@ -202,32 +335,34 @@ func httpExists(url string) (bool, error) {
 	case 400 <= c && c < 500:
 		return false, nil
 	default:
-		return false, fmt.Errorf("Network or server error retrieving: %s", url)
+		return false, &TransientError{
+			Err: fmt.Errorf("Network or server error retrieving: %s", url),
+		}
 	}
 }
 
 func httpGet(url string) (*http.Response, error) {
 	dOut("http get %s\n", url)
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	c := resp.StatusCode
-	if 200 <= c && c < 400 {
-		return resp, nil
-	}
-
-	e, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	s := strings.TrimSpace(string(e[:]))
-	return nil, fmt.Errorf("HTTP error status code: %d (%s)", c, s)
+	return httpDo(req)
 }
 
 func httpPost(url string, bt string, b io.Reader) (*http.Response, error) {
 	dOut("http post %s\n", url)
-	resp, err := http.Post(url, bt, b)
+	req, err := http.NewRequest("POST", url, b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", bt)
+	return httpDo(req)
+}
+
+// Does req (with retries). Unsuccessful responses become errors.
+func httpDo(req *http.Request) (*http.Response, error) {
+	resp, err := doHttpRequest(nil, req)
 	if err != nil {
 		return nil, err
 	}
@@ -237,11 +372,8 @@ func httpPost(url string, bt string, b io.Reader) (*http.Response, error) {
 		return resp, nil
 	}
 
-	e, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-
-	s := strings.TrimSpace(string(e[:]))
-	return nil, fmt.Errorf("HTTP error status code: %d (%s)", c, s)
+	defer resp.Body.Close()
+	return nil, httpStatusError(resp)
 }
 
 func httpReadAll(url string) ([]byte, error) {
@@ -259,21 +391,104 @@ func httpReadAll(url string) ([]byte, error) {
 	return contents, nil
 }
 
+// Downloads url to filename, through filename.partial. Resumes where
+// a previous (failed) download -- or attempt -- left off, if the server
+// allows it.
 func httpWriteToFile(url string, filename string) error {
-	resp, err := httpGet(url)
+	pf, err := openPartial(filename, "")
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer pf.Close()
 
-	file, err := createFile(filename)
+	return configRetryPolicy().Do(func(attempt int) error {
+		return httpResumeToPartial(url, pf)
+	})
+}
+
+func httpResumeToPartial(url string, pf *partialFile) error {
+	dOut("http get %s\n", url)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
-	return err
+	// resume only the version we have part of: if url changed since, the
+	// server sends it whole. (without a validator, we cannot tell.)
+	if pf.Offset > 0 && len(pf.Validator) == 0 {
+		dOut("cannot resume %s (no validator). starting over.\n", url)
+		if err := pf.Truncate(); err != nil {
+			return err
+		}
+	}
+	if pf.Offset > 0 {
+		req.Header.Set("Range", httpRange(pf.Offset, -1))
+		req.Header.Set("If-Range", pf.Validator)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return netError(err)
+	}
+	defer resp.Body.Close()
+
+	c := resp.StatusCode
+	switch {
+	case c == http.StatusPartialContent:
+	case c == http.StatusRequestedRangeNotSatisfiable && pf.Offset > 0:
+		// had it all already -- if it is all there is.
+		if httpCompleteLength(resp) == pf.Offset {
+			return pf.Commit("")
+		}
+		dOut("cannot resume %s (size changed). starting over.\n", url)
+		if err := pf.Truncate(); err != nil {
+			return err
+		}
+		return httpResumeToPartial(url, pf)
+	case 200 <= c && c < 400:
+		// sending everything. start over.
+		if err := pf.Truncate(); err != nil {
+			return err
+		}
+		if err := pf.SetValidator(httpValidator(resp)); err != nil {
+			return err
+		}
+	default:
+		return httpStatusError(resp)
+	}
+
+	_, err = io.Copy(pf, throttle(resp.Body))
+	if err != nil {
+		return netError(err)
+	}
+
+	return pf.Commit("")
+}
+
+// Returns the validator identifying the version of a response's contents
+// (for If-Range): its strong ETag, or else its Last-Modified date.
+func httpValidator(resp *http.Response) string {
+	etag := resp.Header.Get("ETag")
+	if len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// Returns the complete length of the resource, from the Content-Range of a
+// ranged response ("bytes */<length>"). -1 if unknown.
+func httpCompleteLength(resp *http.Response) int64 {
+	cr := resp.Header.Get("Content-Range")
+	slash := strings.LastIndex(cr, "/")
+	if slash < 0 {
+		return -1
+	}
+
+	n, err := strconv.ParseInt(cr[slash+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
 }
 
 func createFile(filename string) (*os.File, error) {
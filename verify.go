@@ -0,0 +1,77 @@
+/*
+Sniperkit-Bot
+- Status: analyzed
+*/
+
+package data
+
+import (
+	"fmt"
+	"hash"
+	"io"
+)
+
+// HashMismatchError reports contents that do not match the hash they are
+// named by (i.e. corrupted, or tampered with).
+type HashMismatchError struct {
+	Path     string // the file, or blob, that failed
+	Expected string
+	Got      string
+}
+
+func (e *HashMismatchError) Error() string {
+	m := "%s hash error (expected %s, got %s)"
+	return fmt.Sprintf(m, e.Path, e.Expected, e.Got)
+}
+
+// verifyingReader hashes contents as they are read. Reaching the end of
+// mismatching contents fails with a HashMismatchError, instead of io.EOF.
+type verifyingReader struct {
+	io.ReadCloser
+	name   string
+	hash   string
+	hasher hash.Hash
+}
+
+func newVerifyingReader(r io.ReadCloser, hash string, name string) (*verifyingReader, error) {
+	h, err := newHasher(hashAlgorithm(hash))
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{ReadCloser: r, name: name, hash: hash, hasher: h}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hasher.Write(p[:n])
+
+	if err == io.EOF {
+		got := formatHash(hashAlgorithm(v.hash), v.hasher.Sum(nil))
+		if got != v.hash {
+			return n, &HashMismatchError{Path: v.name, Expected: v.hash, Got: got}
+		}
+	}
+	return n, err
+}
+
+// Wraps blob reader r (reading from the start) to verify it.
+func verifyBlob(r io.ReadCloser, hash string) (io.ReadCloser, error) {
+	v, err := newVerifyingReader(r, hash, "blob "+shortHash(hash))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+// Names dest (the file the blob is written to) in err, if the blob (or one
+// of its chunks) failed to verify, so users know which file is corrupt.
+func verifyErrorFor(err error, dest string) error {
+	e, ok := err.(*HashMismatchError)
+	if !ok || e.Path == dest {
+		return err
+	}
+
+	path := fmt.Sprintf("%s (%s)", dest, e.Path)
+	return &HashMismatchError{Path: path, Expected: e.Expected, Got: e.Got}
+}